@@ -4,8 +4,13 @@ import (
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/sandstorm/caddy-nats-bridge/body_jetstream"
+	"github.com/sandstorm/caddy-nats-bridge/configloader"
+	"github.com/sandstorm/caddy-nats-bridge/eventpublish"
+	"github.com/sandstorm/caddy-nats-bridge/format"
+	"github.com/sandstorm/caddy-nats-bridge/kv"
 	"github.com/sandstorm/caddy-nats-bridge/logoutput"
 	"github.com/sandstorm/caddy-nats-bridge/natsbridge"
+	"github.com/sandstorm/caddy-nats-bridge/objectserver"
 	"github.com/sandstorm/caddy-nats-bridge/publish"
 	"github.com/sandstorm/caddy-nats-bridge/request"
 	"github.com/sandstorm/caddy-nats-bridge/subscribe"
@@ -14,6 +19,7 @@ import (
 func init() {
 	caddy.RegisterModule(natsbridge.NatsBridgeApp{})
 	httpcaddyfile.RegisterGlobalOption("nats", natsbridge.ParseGobalNatsOption)
+	caddy.RegisterModule(natsbridge.AdminAPI{})
 	caddy.RegisterModule(subscribe.Subscribe{})
 
 	caddy.RegisterModule(publish.Publish{})
@@ -22,10 +28,29 @@ func init() {
 	caddy.RegisterModule(request.Request{})
 	httpcaddyfile.RegisterHandlerDirective("nats_request", request.ParseRequestHandler)
 
+	// message formats for nats_publish, nats_request and subscribe
+	caddy.RegisterModule(format.Raw{})
+	caddy.RegisterModule(format.JSON{})
+	caddy.RegisterModule(format.CloudEvents{})
+
 	// store request body to Jetstream
 	caddy.RegisterModule(body_jetstream.StoreBodyToJetStream{})
 	httpcaddyfile.RegisterHandlerDirective("store_body_to_jetstream", body_jetstream.ParseStoreBodyToJetstream)
 
+	// JetStream Key-Value buckets via HTTP
+	caddy.RegisterModule(kv.KeyValue{})
+	httpcaddyfile.RegisterHandlerDirective("nats_kv", kv.ParseKeyValueHandler)
+
+	// JetStream Object Store buckets as static files
+	caddy.RegisterModule(objectserver.ObjectServer{})
+	httpcaddyfile.RegisterHandlerDirective("nats_object_server", objectserver.ParseObjectServerHandler)
+
+	// Caddy config from a JetStream KV bucket
+	caddy.RegisterModule(configloader.KeyValueLoader{})
+
 	// logging output to NATS
 	caddy.RegisterModule(logoutput.LogOutput{})
+
+	// Caddy events to NATS
+	caddy.RegisterModule(eventpublish.EventPublish{})
 }
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"github.com/nats-io/nats.go"
 	_ "github.com/sandstorm/caddy-nats-bridge"
+	"github.com/sandstorm/caddy-nats-bridge/common"
 	"github.com/sandstorm/caddy-nats-bridge/integrationtest"
+	"io"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 )
@@ -104,6 +107,53 @@ func TestPublishRequestToNatsWithBodyJetstream(t *testing.T) {
 			},
 		},
 
+		{
+			description: "with encrypt, the body should be stored encrypted",
+			buildHttpRequest: func(t *testing.T) *http.Request {
+				body := []byte("my secret request body")
+				req, err := http.NewRequest("POST", "http://127.0.0.1:8889/test/hi", bytes.NewReader(body))
+				integrationtest.FailOnErr("Error creating request: %w", err, t)
+				return req
+			},
+			GlobalNatsCaddyfileSnippet: ``,
+			CaddyfileSnippet: `
+				route /test/* {
+					store_body_to_jetstream {
+						encrypt aes-gcm {
+							key k1 MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=
+						}
+					}
+					nats_publish greet.hello
+				}
+			`,
+			assertNatsMessage: func(msg *nats.Msg, nc *nats.Conn, t *testing.T) {
+				js, err := nc.JetStream()
+				integrationtest.FailOnErr("Error getting JetStream ClientConn: %s", err, t)
+				os, err := js.ObjectStore(msg.Header.Get("X-NatsBridge-Body-Bucket"))
+				integrationtest.FailOnErr("Error getting ObjectStore: %s", err, t)
+				obj, err := os.Get(msg.Header.Get("X-NatsBridge-Body-Id"))
+				integrationtest.FailOnErr("Error getting Key from ObjectStore: %s", err, t)
+				defer obj.Close()
+				info, err := obj.Info()
+				integrationtest.FailOnErr("Error getting object info: %s", err, t)
+				ciphertext, err := io.ReadAll(obj)
+				integrationtest.FailOnErr("Error reading object: %s", err, t)
+
+				if strings.Contains(string(ciphertext), "secret") {
+					t.Fatalf("body must be stored encrypted. Actual: %s", ciphertext)
+				}
+				e := &common.Encryption{
+					Algorithm: common.EncryptionAESGCM,
+					Keys:      map[string]*common.EncryptionKey{"k1": {Key: "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE="}},
+				}
+				integrationtest.FailOnErr("Error provisioning encryption: %s", e.Provision(), t)
+				plaintext, err := e.Open(info.Headers.Get(common.HeaderEncryption), info.Headers.Get(common.HeaderKeyId), ciphertext, []byte(info.Name))
+				integrationtest.FailOnErr("Error decrypting body: %s", err, t)
+				if string(plaintext) != "my secret request body" {
+					t.Fatalf("decrypted body does not match. Actual: %s", plaintext)
+				}
+			},
+		},
 		// TODO realistic case with Transfer-Encoding chunked:
 		//// // NOTE: we need to use bufio.NewReader, to enforce a Transfer-Encoding=chunked. See net.http.NewRequestWithContext from Go Stdlib.
 		//				req, err := http.NewRequest("POST", "http://127.0.0.1:8889/test/hi", bufio.NewReader(strings.NewReader("Small Request Body, but chunked transfer encoding")))
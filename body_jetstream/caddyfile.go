@@ -4,6 +4,7 @@ import (
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/sandstorm/caddy-nats-bridge/common"
 	"time"
 )
 
@@ -11,6 +12,9 @@ import (
 //
 //	store_body_to_jetstream [<matcher>] [bucketName] {
 //	    [ttl 5m]
+//	    [encrypt aes-gcm|nacl-box {
+//	        # see common.ParseEncryption
+//	    }]
 //	}
 func ParseStoreBodyToJetstream(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var sb = StoreBodyToJetStream{
@@ -42,6 +46,12 @@ func ParseStoreBodyToJetstream(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHand
 					return nil, h.Err("TTL is not a valid duration")
 				}
 				sb.TTL = ttl
+			case "encrypt":
+				encrypt, err := common.ParseEncryption(h.Dispenser)
+				if err != nil {
+					return nil, err
+				}
+				sb.Encrypt = encrypt
 			default:
 				return nil, h.Errf("unrecognized subdirective: %s", h.Val())
 			}
@@ -21,6 +21,8 @@ type StoreBodyToJetStream struct {
 	TTL    time.Duration `json:"ttl,omitempty"`
 	// in which NATS server should the request body be stored?
 	ServerAlias string `json:"serverAlias,omitempty"`
+	// encrypts the stored body; the encryption headers are stored in the object metadata.
+	Encrypt *common.Encryption `json:"encrypt,omitempty"`
 
 	app    *natsbridge.NatsBridgeApp
 	logger *zap.Logger
@@ -45,6 +47,11 @@ func (sb *StoreBodyToJetStream) Provision(ctx caddy.Context) error {
 
 	sb.app = natsAppIface.(*natsbridge.NatsBridgeApp)
 
+	err = sb.Encrypt.Provision()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -77,9 +84,20 @@ func (sb *StoreBodyToJetStream) ServeHTTP(writer http.ResponseWriter, request *h
 		// So that's why we can easily read the full body here anyways to simplify code paths; and then we can
 		// decide based on the actual length; and not based of the ContentLength Header.
 		// In case we want to change it somewhen, we need to take care of Chunked Uploads via r.ContentLength == -1 || r.ContentLength > 950_000_000
-		_, err = os.Put(&nats.ObjectMeta{
+		meta := &nats.ObjectMeta{
 			Name: id,
-		}, bytes.NewReader(b)) // TODO: we cannot directly stream request.Body to os.Put, although it should work type-wise - so we read the full resp into bytes
+		}
+		if sb.Encrypt != nil {
+			// the object name is authenticated; so the body cannot be swapped with another one.
+			b, err = sb.Encrypt.Seal(b, []byte(id))
+			if err != nil {
+				return fmt.Errorf("cannot encrypt request body: %w", err)
+			}
+			meta.Headers = nats.Header{}
+			meta.Headers.Set(common.HeaderEncryption, sb.Encrypt.Algorithm)
+			meta.Headers.Set(common.HeaderKeyId, sb.Encrypt.KeyID)
+		}
+		_, err = os.Put(meta, bytes.NewReader(b)) // TODO: we cannot directly stream request.Body to os.Put, although it should work type-wise - so we read the full resp into bytes
 		if err != nil {
 			return fmt.Errorf("cannot store binary to Object Store %s: %w", sb.Bucket, err)
 		}
@@ -0,0 +1,188 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nats-io/nats.go"
+	"io"
+	"sync"
+)
+
+// HeaderCompression marks payloads compressed by the bridge, with the algorithm as value. This is deliberately not
+// Content-Encoding: that is an ordinary HTTP header (f.e. of a compressed upload), which the bridge passes through.
+const HeaderCompression = "X-NatsBridge-Compression"
+
+// headerContentEncoding is the HTTP header of compressed HTTP bodies.
+const headerContentEncoding = "Content-Encoding"
+
+// the supported compression algorithms; also used as value of the HeaderCompression header.
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	// s2 block format (not the stream format), see github.com/klauspost/compress/s2.
+	CompressionS2 = "s2"
+)
+
+// MaxDecompressedSize limits the size of decompressed payloads, to protect against decompression bombs.
+const MaxDecompressedSize = 64 << 20
+
+// Compression compresses the payload of outgoing messages.
+type Compression struct {
+	// CompressionGzip, CompressionZstd or CompressionS2.
+	Algorithm string `json:"algorithm,omitempty"`
+	// payloads smaller than this (in bytes) are sent uncompressed; 0 compresses all payloads.
+	MinSize int `json:"minSize,omitempty"`
+}
+
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil)
+	})
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxDecompressedSize))
+	})
+)
+
+// Validate checks the configured algorithm; a nil Compression is valid.
+func (c *Compression) Validate() error {
+	if c == nil {
+		return nil
+	}
+	switch c.Algorithm {
+	case CompressionGzip, CompressionZstd, CompressionS2:
+		return nil
+	default:
+		return fmt.Errorf("compression algorithm must be %s, %s or %s, got: %s", CompressionGzip, CompressionZstd, CompressionS2, c.Algorithm)
+	}
+}
+
+// Compress compresses the payload of the message in place, and sets the HeaderCompression header. Empty or small
+// payloads, and payloads which are already compressed (by the bridge or the HTTP client), are left untouched; as is
+// everything for a nil Compression.
+func (c *Compression) Compress(msg *nats.Msg) error {
+	if c == nil || len(msg.Data) == 0 || len(msg.Data) < c.MinSize ||
+		msg.Header.Get(HeaderCompression) != "" || msg.Header.Get(headerContentEncoding) != "" {
+		return nil
+	}
+
+	var compressed []byte
+	switch c.Algorithm {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(msg.Data)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("could not compress payload: %w", err)
+		}
+		compressed = buf.Bytes()
+	case CompressionZstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return fmt.Errorf("could not create zstd encoder: %w", err)
+		}
+		compressed = enc.EncodeAll(msg.Data, nil)
+	case CompressionS2:
+		compressed = s2.Encode(nil, msg.Data)
+	default:
+		return fmt.Errorf("unknown compression algorithm: %s", c.Algorithm)
+	}
+
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	msg.Header.Set(HeaderCompression, c.Algorithm)
+	msg.Data = compressed
+	return nil
+}
+
+// Decompress returns the message with decompressed payload, if it has a HeaderCompression header; otherwise the
+// message itself. The given message is not modified, and subject, reply subject and subscription are kept. Other
+// headers (like Content-Encoding) are not touched. A nil Compression does not decompress anything.
+func (c *Compression) Decompress(msg *nats.Msg) (*nats.Msg, error) {
+	if c == nil {
+		return msg, nil
+	}
+	algorithm := msg.Header.Get(HeaderCompression)
+	if algorithm == "" {
+		return msg, nil
+	}
+
+	var data []byte
+	var err error
+	switch algorithm {
+	case CompressionGzip:
+		var r *gzip.Reader
+		r, err = gzip.NewReader(bytes.NewReader(msg.Data))
+		if err == nil {
+			data, err = io.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+		}
+		if err == nil && len(data) > MaxDecompressedSize {
+			err = fmt.Errorf("decompressed payload larger than %d bytes", MaxDecompressedSize)
+		}
+	case CompressionZstd:
+		var dec *zstd.Decoder
+		dec, err = zstdDecoder()
+		if err == nil {
+			data, err = dec.DecodeAll(msg.Data, nil)
+		}
+	case CompressionS2:
+		var n int
+		n, err = s2.DecodedLen(msg.Data)
+		if err == nil && n > MaxDecompressedSize {
+			err = fmt.Errorf("decompressed payload larger than %d bytes", MaxDecompressedSize)
+		}
+		if err == nil {
+			data, err = s2.Decode(nil, msg.Data)
+		}
+	default:
+		err = fmt.Errorf("unknown compression algorithm")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress %s payload: %w", algorithm, err)
+	}
+
+	header := nats.Header{}
+	for k, v := range msg.Header {
+		header[k] = v
+	}
+	header.Del(HeaderCompression)
+	return &nats.Msg{
+		Subject: msg.Subject,
+		Reply:   msg.Reply,
+		Sub:     msg.Sub,
+		Header:  header,
+		Data:    data,
+	}, nil
+}
+
+// ParseCompression parses the compress subdirective. Syntax:
+//
+//	compress gzip|zstd|s2 [min_size]
+func ParseCompression(d *caddyfile.Dispenser) (*Compression, error) {
+	c := &Compression{}
+	args := d.RemainingArgs()
+	if len(args) < 1 || len(args) > 2 {
+		return nil, d.ArgErr()
+	}
+	c.Algorithm = args[0]
+	err := c.Validate()
+	if err != nil {
+		return nil, d.Err(err.Error())
+	}
+	if len(args) == 2 {
+		minSize, err := humanize.ParseBytes(args[1])
+		if err != nil {
+			return nil, d.Errf("compress: invalid min_size: %s", args[1])
+		}
+		c.MinSize = int(minSize)
+	}
+	return c, nil
+}
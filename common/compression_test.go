@@ -0,0 +1,104 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestCompression(t *testing.T) {
+	payload := []byte(strings.Repeat(`{"hello": "world"}`, 100))
+
+	for _, algorithm := range []string{CompressionGzip, CompressionZstd, CompressionS2} {
+		t.Run(algorithm, func(t *testing.T) {
+			c := &Compression{Algorithm: algorithm}
+			msg := &nats.Msg{Subject: "foo", Reply: "bar", Data: payload}
+			err := c.Compress(msg)
+			if err != nil {
+				t.Fatalf("could not compress: %v", err)
+			}
+			if msg.Header.Get(HeaderCompression) != algorithm {
+				t.Fatalf("compression header not set, actual headers: %+v", msg.Header)
+			}
+			if len(msg.Data) >= len(payload) {
+				t.Fatalf("payload not compressed: %d >= %d bytes", len(msg.Data), len(payload))
+			}
+
+			decompressed, err := c.Decompress(msg)
+			if err != nil {
+				t.Fatalf("could not decompress: %v", err)
+			}
+			if !bytes.Equal(decompressed.Data, payload) {
+				t.Fatalf("payload not restored: %s", decompressed.Data)
+			}
+			if decompressed.Header.Get(HeaderCompression) != "" || msg.Header.Get(HeaderCompression) != algorithm {
+				t.Fatalf("the compression header must only be removed from the decompressed message")
+			}
+			if decompressed.Subject != "foo" || decompressed.Reply != "bar" {
+				t.Fatalf("subject and reply not kept: %+v", decompressed)
+			}
+		})
+	}
+}
+
+func TestCompressionSkipped(t *testing.T) {
+	c := &Compression{Algorithm: CompressionGzip, MinSize: 1024}
+
+	small := &nats.Msg{Data: []byte("small")}
+	err := c.Compress(small)
+	if err != nil || string(small.Data) != "small" || small.Header.Get(HeaderCompression) != "" {
+		t.Fatalf("payloads smaller than min_size must not be compressed: %+v (%v)", small, err)
+	}
+
+	alreadyEncoded := nats.NewMsg("foo")
+	alreadyEncoded.Header.Set("Content-Encoding", "br")
+	alreadyEncoded.Data = bytes.Repeat([]byte("a"), 2048)
+	err = c.Compress(alreadyEncoded)
+	if err != nil || len(alreadyEncoded.Data) != 2048 {
+		t.Fatalf("payloads with Content-Encoding must not be compressed again: %v", err)
+	}
+	decompressed, err := c.Decompress(alreadyEncoded)
+	if err != nil || decompressed != alreadyEncoded {
+		t.Fatalf("Content-Encoding must be left untouched: %v", err)
+	}
+
+	// a compressed HTTP upload is not decompressed, even with the same algorithm.
+	gzipUpload := nats.NewMsg("foo")
+	gzipUpload.Header.Set("Content-Encoding", CompressionGzip)
+	gzipUpload.Header.Set("Content-Length", "16")
+	gzipUpload.Data = []byte("not decompressed")
+	decompressed, err = c.Decompress(gzipUpload)
+	if err != nil || decompressed != gzipUpload {
+		t.Fatalf("Content-Encoding must be left untouched: %v", err)
+	}
+
+	var nilCompression *Compression
+	if nilCompression.Validate() != nil || nilCompression.Compress(small) != nil {
+		t.Fatalf("nil compression must be a no-op")
+	}
+	gzipped := nats.NewMsg("foo")
+	gzipped.Header.Set(HeaderCompression, CompressionGzip)
+	gzipped.Data = []byte("not decompressed")
+	decompressed, err = nilCompression.Decompress(gzipped)
+	if err != nil || decompressed != gzipped {
+		t.Fatalf("nil compression must not decompress: %v", err)
+	}
+}
+
+func TestDecompressInvalidPayload(t *testing.T) {
+	msg := nats.NewMsg("foo")
+	msg.Header.Set(HeaderCompression, CompressionGzip)
+	msg.Data = []byte("not gzip")
+	_, err := (&Compression{Algorithm: CompressionGzip}).Decompress(msg)
+	if err == nil {
+		t.Fatalf("expected an error for an invalid payload")
+	}
+
+	msg.Header.Set(HeaderCompression, "br")
+	_, err = (&Compression{Algorithm: CompressionGzip}).Decompress(msg)
+	if err == nil {
+		t.Fatalf("expected an error for an unknown algorithm")
+	}
+}
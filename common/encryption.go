@@ -0,0 +1,342 @@
+package common
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/nats-io/nats.go"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"os"
+	"strings"
+)
+
+// Headers describing the encryption of a message payload.
+const (
+	HeaderEncryption = "X-NatsBridge-Encryption"
+	HeaderKeyId      = "X-NatsBridge-Key-Id"
+)
+
+// the supported encryption algorithms; also used as value of the HeaderEncryption header. Both authenticate the key ID
+// and a context (for messages: the subject and the EncryptionBoundHeaders) together with the payload.
+const (
+	// AES-GCM with a 128, 192 or 256 bit key; the payload is nonce + ciphertext, the key ID and context are the
+	// additional data.
+	EncryptionAESGCM = "aes-gcm"
+	// NaCl anonymous sealed box (X25519, XSalsa20-Poly1305); encrypting only needs the public key of the receiver. The
+	// sealed plaintext is the SHA-256 hash of key ID and context, followed by the payload.
+	EncryptionNaClBox = "nacl-box"
+)
+
+// EncryptionBoundHeaders are authenticated (but not encrypted) together with the payload; so that a captured message
+// cannot be replayed with another method or URL (or with a changed compression marker).
+var EncryptionBoundHeaders = []string{HeaderMethod, HeaderUrlPath, HeaderUrlQuery, HeaderCompression}
+
+// Encryption encrypts the payload of outgoing messages, and decrypts the payload of incoming ones. All Keys are used
+// for decrypting (identified by the HeaderKeyId header); so keys can be rotated by adding a new key, switching KeyID
+// to it on the sending side, and removing the old key once all messages encrypted with it are consumed.
+//
+// With nacl-box, the replies of subscribe are encrypted with ReplyKeyID: the public key of the requesting side, so
+// that it does not need the private key of the receiver.
+type Encryption struct {
+	// EncryptionAESGCM or EncryptionNaClBox.
+	Algorithm string `json:"algorithm,omitempty"`
+	// ID of the key used for encrypting; can be omitted if there is only one key.
+	KeyID string `json:"keyId,omitempty"`
+	// ID of the key used for encrypting replies; KeyID if not set. Required for replies with nacl-box.
+	ReplyKeyID string                    `json:"replyKeyId,omitempty"`
+	Keys       map[string]*EncryptionKey `json:"keys,omitempty"`
+}
+
+// EncryptionKey is a base64 encoded key; either given directly or read from a file.
+type EncryptionKey struct {
+	// supports placeholders, f.e. {env.NATS_BRIDGE_KEY}.
+	Key     string `json:"key,omitempty"`
+	KeyFile string `json:"keyFile,omitempty"`
+	// nacl-box only: the key is the public key of the receiver; so it can only be used for encrypting.
+	Public bool `json:"public,omitempty"`
+
+	// aes-gcm: the AEAD; nacl-box: the private key (nil for public keys).
+	aead    cipher.AEAD
+	private *[32]byte
+	public  *[32]byte
+}
+
+// Provision validates the configuration and loads the keys; a nil Encryption is valid.
+func (e *Encryption) Provision() error {
+	if e == nil {
+		return nil
+	}
+	if e.Algorithm != EncryptionAESGCM && e.Algorithm != EncryptionNaClBox {
+		return fmt.Errorf("encryption algorithm must be %s or %s, got: %s", EncryptionAESGCM, EncryptionNaClBox, e.Algorithm)
+	}
+	if len(e.Keys) == 0 {
+		return fmt.Errorf("encryption: no keys configured")
+	}
+	if e.KeyID == "" && len(e.Keys) == 1 {
+		for id := range e.Keys {
+			e.KeyID = id
+		}
+	}
+	if _, ok := e.Keys[e.KeyID]; !ok {
+		return fmt.Errorf("encryption: key %q not found", e.KeyID)
+	}
+	if _, ok := e.Keys[e.ReplyKeyID]; e.ReplyKeyID != "" && !ok {
+		return fmt.Errorf("encryption: reply key %q not found", e.ReplyKeyID)
+	}
+
+	repl := caddy.NewReplacer()
+	for id, key := range e.Keys {
+		err := key.load(e.Algorithm, repl)
+		if err != nil {
+			return fmt.Errorf("encryption: key %q: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func (k *EncryptionKey) load(algorithm string, repl *caddy.Replacer) error {
+	encoded := repl.ReplaceAll(k.Key, "")
+	if k.KeyFile != "" {
+		b, err := os.ReadFile(k.KeyFile)
+		if err != nil {
+			return err
+		}
+		encoded = string(b)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return fmt.Errorf("key is not base64 encoded: %w", err)
+	}
+
+	if algorithm == EncryptionAESGCM {
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return err
+		}
+		k.aead, err = cipher.NewGCM(block)
+		return err
+	}
+
+	if len(raw) != 32 {
+		return fmt.Errorf("nacl-box keys must be 32 bytes, got %d", len(raw))
+	}
+	key := (*[32]byte)(raw)
+	if k.Public {
+		k.public = key
+		return nil
+	}
+	public, err := curve25519.X25519(raw, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	k.private = key
+	k.public = (*[32]byte)(public)
+	return nil
+}
+
+// Seal encrypts the plaintext with the key KeyID; context is authenticated, and must be given to Open as well.
+func (e *Encryption) Seal(plaintext []byte, context []byte) ([]byte, error) {
+	return e.seal(e.KeyID, plaintext, context)
+}
+
+func (e *Encryption) seal(keyID string, plaintext []byte, context []byte) ([]byte, error) {
+	key := e.Keys[keyID]
+	ad := additionalData(keyID, context)
+	if e.Algorithm == EncryptionAESGCM {
+		nonce := make([]byte, key.aead.NonceSize(), key.aead.NonceSize()+len(plaintext)+key.aead.Overhead())
+		_, err := rand.Read(nonce)
+		if err != nil {
+			return nil, err
+		}
+		return key.aead.Seal(nonce, nonce, plaintext, ad), nil
+	}
+	// sealed boxes have no additional data; so its hash is sealed with the plaintext.
+	digest := sha256.Sum256(ad)
+	return box.SealAnonymous(nil, append(digest[:], plaintext...), key.public, rand.Reader)
+}
+
+// Open decrypts a ciphertext created by Seal with the given algorithm, key and context.
+func (e *Encryption) Open(algorithm string, keyID string, ciphertext []byte, context []byte) ([]byte, error) {
+	if algorithm != e.Algorithm {
+		return nil, fmt.Errorf("payload encrypted with %s, but %s is configured", algorithm, e.Algorithm)
+	}
+	key, ok := e.Keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", keyID)
+	}
+
+	ad := additionalData(keyID, context)
+	if e.Algorithm == EncryptionAESGCM {
+		if len(ciphertext) < key.aead.NonceSize() {
+			return nil, fmt.Errorf("payload too short")
+		}
+		nonce, sealed := ciphertext[:key.aead.NonceSize()], ciphertext[key.aead.NonceSize():]
+		return key.aead.Open(nil, nonce, sealed, ad)
+	}
+	if key.private == nil {
+		return nil, fmt.Errorf("key %q is a public key, and cannot decrypt", keyID)
+	}
+	plaintext, ok := box.OpenAnonymous(nil, ciphertext, key.public, key.private)
+	digest := sha256.Sum256(ad)
+	if !ok || len(plaintext) < len(digest) || !bytes.Equal(plaintext[:len(digest)], digest[:]) {
+		return nil, fmt.Errorf("could not open nacl box")
+	}
+	return plaintext[len(digest):], nil
+}
+
+// additionalData returns the data authenticated with the payload.
+func additionalData(keyID string, context []byte) []byte {
+	return append([]byte(keyID+"\x00"), context...)
+}
+
+// messageContext returns the subject and the EncryptionBoundHeaders of the message, which are authenticated with its
+// payload.
+func messageContext(msg *nats.Msg) []byte {
+	var b strings.Builder
+	b.WriteString(msg.Subject)
+	for _, name := range EncryptionBoundHeaders {
+		b.WriteString("\n" + name + ": " + strings.Join(msg.Header.Values(name), ", "))
+	}
+	return []byte(b.String())
+}
+
+// Encrypt encrypts the payload of the message in place (also if it is empty, so that every message is authenticated),
+// and sets the HeaderEncryption and HeaderKeyId headers. The subject and the EncryptionBoundHeaders must be set
+// before. Nothing is done for a nil Encryption.
+func (e *Encryption) Encrypt(msg *nats.Msg) error {
+	if e == nil {
+		return nil
+	}
+	return e.encrypt(e.KeyID, msg)
+}
+
+// EncryptReply encrypts a reply like Encrypt, but with the key ReplyKeyID; its subject must be the reply subject of
+// the request.
+func (e *Encryption) EncryptReply(msg *nats.Msg) error {
+	if e == nil {
+		return nil
+	}
+	keyID := e.ReplyKeyID
+	if keyID == "" {
+		if e.Algorithm == EncryptionNaClBox {
+			// the own key would force the requesting side to hold the private key of this side.
+			return fmt.Errorf("replies with %s need a reply key (the public key of the requesting side)", EncryptionNaClBox)
+		}
+		keyID = e.KeyID
+	}
+	return e.encrypt(keyID, msg)
+}
+
+func (e *Encryption) encrypt(keyID string, msg *nats.Msg) error {
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	sealed, err := e.seal(keyID, msg.Data, messageContext(msg))
+	if err != nil {
+		return fmt.Errorf("could not encrypt payload: %w", err)
+	}
+	msg.Header.Set(HeaderEncryption, e.Algorithm)
+	msg.Header.Set(HeaderKeyId, keyID)
+	msg.Data = sealed
+	return nil
+}
+
+// Decrypt returns the message with decrypted payload. Messages without HeaderEncryption header are rejected; otherwise
+// anybody allowed to publish could inject unauthenticated messages. A nil Encryption returns the message itself. The
+// given message is not modified, and subject, reply subject and subscription are kept.
+func (e *Encryption) Decrypt(msg *nats.Msg) (*nats.Msg, error) {
+	if e == nil {
+		return msg, nil
+	}
+	algorithm := msg.Header.Get(HeaderEncryption)
+	if algorithm == "" {
+		return nil, fmt.Errorf("unencrypted message rejected, as encryption is configured")
+	}
+	data, err := e.Open(algorithm, msg.Header.Get(HeaderKeyId), msg.Data, messageContext(msg))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt payload: %w", err)
+	}
+
+	header := nats.Header{}
+	for k, v := range msg.Header {
+		header[k] = v
+	}
+	header.Del(HeaderEncryption)
+	header.Del(HeaderKeyId)
+	return &nats.Msg{
+		Subject: msg.Subject,
+		Reply:   msg.Reply,
+		Sub:     msg.Sub,
+		Header:  header,
+		Data:    data,
+	}, nil
+}
+
+// ParseEncryption parses the encrypt subdirective. Syntax:
+//
+//	encrypt aes-gcm|nacl-box {
+//	    key id base64Key [public]
+//	    key_file id path [public]
+//	    [key_id id]
+//	    [reply_key_id id]
+//	}
+//
+// If key_id is not given, the first key is used for encrypting.
+func ParseEncryption(d *caddyfile.Dispenser) (*Encryption, error) {
+	e := &Encryption{Keys: map[string]*EncryptionKey{}}
+	if !d.Args(&e.Algorithm) {
+		return nil, d.ArgErr()
+	}
+	if e.Algorithm != EncryptionAESGCM && e.Algorithm != EncryptionNaClBox {
+		return nil, d.Errf("encryption algorithm must be %s or %s, got: %s", EncryptionAESGCM, EncryptionNaClBox, e.Algorithm)
+	}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "key", "key_file":
+			directive := d.Val()
+			args := d.RemainingArgs()
+			if len(args) < 2 || len(args) > 3 || (len(args) == 3 && args[2] != "public") {
+				return nil, d.ArgErr()
+			}
+			key := &EncryptionKey{Public: len(args) == 3}
+			if directive == "key" {
+				key.Key = args[1]
+			} else {
+				key.KeyFile = args[1]
+			}
+			if _, ok := e.Keys[args[0]]; ok {
+				return nil, d.Errf("duplicate key %s", args[0])
+			}
+			e.Keys[args[0]] = key
+			if e.KeyID == "" {
+				e.KeyID = args[0]
+			}
+		case "key_id":
+			if !d.AllArgs(&e.KeyID) {
+				return nil, d.ArgErr()
+			}
+		case "reply_key_id":
+			if !d.AllArgs(&e.ReplyKeyID) {
+				return nil, d.ArgErr()
+			}
+		default:
+			return nil, d.Errf("unrecognized encrypt subdirective: %s", d.Val())
+		}
+	}
+
+	if len(e.Keys) == 0 {
+		return nil, d.Err("encrypt: at least one key is required")
+	}
+	return e, nil
+}
@@ -0,0 +1,281 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func provisionedEncryption(t *testing.T, e *Encryption) *Encryption {
+	err := e.Provision()
+	if err != nil {
+		t.Fatalf("could not provision encryption: %v", err)
+	}
+	return e
+}
+
+func TestEncryption(t *testing.T) {
+	payload := []byte("my secret form submission")
+
+	for _, algorithm := range []string{EncryptionAESGCM, EncryptionNaClBox} {
+		t.Run(algorithm, func(t *testing.T) {
+			e := provisionedEncryption(t, &Encryption{
+				Algorithm: algorithm,
+				Keys:      map[string]*EncryptionKey{"k1": {Key: testKey(1)}},
+			})
+
+			msg := &nats.Msg{Subject: "foo", Reply: "bar", Data: payload}
+			err := e.Encrypt(msg)
+			if err != nil {
+				t.Fatalf("could not encrypt: %v", err)
+			}
+			if msg.Header.Get(HeaderEncryption) != algorithm || msg.Header.Get(HeaderKeyId) != "k1" {
+				t.Fatalf("encryption headers not set, actual headers: %+v", msg.Header)
+			}
+			if bytes.Contains(msg.Data, payload) {
+				t.Fatalf("payload not encrypted")
+			}
+
+			decrypted, err := e.Decrypt(msg)
+			if err != nil {
+				t.Fatalf("could not decrypt: %v", err)
+			}
+			if !bytes.Equal(decrypted.Data, payload) || decrypted.Header.Get(HeaderEncryption) != "" {
+				t.Fatalf("payload not restored: %s %+v", decrypted.Data, decrypted.Header)
+			}
+			if decrypted.Subject != "foo" || decrypted.Reply != "bar" {
+				t.Fatalf("subject and reply not kept: %+v", decrypted)
+			}
+
+			msg.Data[len(msg.Data)-1] ^= 1
+			_, err = e.Decrypt(msg)
+			if err == nil {
+				t.Fatalf("tampered payload must not be decrypted")
+			}
+		})
+	}
+}
+
+// TestEncryptionRejectsPlaintext checks that unencrypted messages are not accepted if encryption is configured; also
+// if they have no payload.
+func TestEncryptionRejectsPlaintext(t *testing.T) {
+	e := provisionedEncryption(t, &Encryption{
+		Algorithm: EncryptionAESGCM,
+		Keys:      map[string]*EncryptionKey{"k1": {Key: testKey(1)}},
+	})
+
+	_, err := e.Decrypt(&nats.Msg{Subject: "foo", Data: []byte("injected plaintext")})
+	if err == nil {
+		t.Fatalf("plaintext payload must be rejected")
+	}
+	_, err = e.Decrypt(&nats.Msg{Subject: "foo", Header: nats.Header{HeaderMethod: []string{"DELETE"}}})
+	if err == nil {
+		t.Fatalf("message without payload must be rejected")
+	}
+
+	// empty payloads are sealed as well.
+	empty := &nats.Msg{Subject: "foo", Header: nats.Header{HeaderMethod: []string{"DELETE"}}}
+	err = e.Encrypt(empty)
+	if err != nil || empty.Header.Get(HeaderEncryption) != EncryptionAESGCM || len(empty.Data) == 0 {
+		t.Fatalf("empty payload must be encrypted: %v %+v", err, empty)
+	}
+	decrypted, err := e.Decrypt(empty)
+	if err != nil || len(decrypted.Data) != 0 {
+		t.Fatalf("could not decrypt empty payload: %v", err)
+	}
+
+	var disabled *Encryption
+	plain := &nats.Msg{Subject: "foo", Data: []byte("plaintext")}
+	decrypted, err = disabled.Decrypt(plain)
+	if err != nil || decrypted != plain {
+		t.Fatalf("plaintext must be passed through without encryption: %v", err)
+	}
+}
+
+// TestEncryptionBindsSubjectAndHeaders checks that a captured message cannot be replayed to another subject, or with
+// other routing headers.
+func TestEncryptionBindsSubjectAndHeaders(t *testing.T) {
+	for _, algorithm := range []string{EncryptionAESGCM, EncryptionNaClBox} {
+		t.Run(algorithm, func(t *testing.T) {
+			e := provisionedEncryption(t, &Encryption{
+				Algorithm: algorithm,
+				Keys:      map[string]*EncryptionKey{"k1": {Key: testKey(1)}},
+			})
+			encrypted := func() *nats.Msg {
+				msg := &nats.Msg{Subject: "orders.get", Header: nats.Header{}, Data: []byte("payload")}
+				msg.Header.Set(HeaderMethod, "GET")
+				msg.Header.Set(HeaderUrlPath, "/orders/1")
+				err := e.Encrypt(msg)
+				if err != nil {
+					t.Fatalf("could not encrypt: %v", err)
+				}
+				return msg
+			}
+
+			_, err := e.Decrypt(encrypted())
+			if err != nil {
+				t.Fatalf("could not decrypt: %v", err)
+			}
+			for name, tamper := range map[string]func(msg *nats.Msg){
+				"subject":     func(msg *nats.Msg) { msg.Subject = "orders.delete" },
+				"method":      func(msg *nats.Msg) { msg.Header.Set(HeaderMethod, "DELETE") },
+				"path":        func(msg *nats.Msg) { msg.Header.Set(HeaderUrlPath, "/orders/2") },
+				"added query": func(msg *nats.Msg) { msg.Header.Set(HeaderUrlQuery, "force=1") },
+			} {
+				msg := encrypted()
+				tamper(msg)
+				_, err = e.Decrypt(msg)
+				if err == nil {
+					t.Errorf("%s: tampered message must not be decrypted", name)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "old.key")
+	err := os.WriteFile(keyFile, []byte(testKey(1)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := provisionedEncryption(t, &Encryption{
+		Algorithm: EncryptionAESGCM,
+		Keys:      map[string]*EncryptionKey{"old": {KeyFile: keyFile}},
+	})
+	rotated := provisionedEncryption(t, &Encryption{
+		Algorithm: EncryptionAESGCM,
+		KeyID:     "new",
+		Keys: map[string]*EncryptionKey{
+			"old": {KeyFile: keyFile},
+			"new": {Key: testKey(2)},
+		},
+	})
+
+	msg := &nats.Msg{Data: []byte("hello")}
+	err = old.Encrypt(msg)
+	if err != nil {
+		t.Fatalf("could not encrypt: %v", err)
+	}
+	decrypted, err := rotated.Decrypt(msg)
+	if err != nil || string(decrypted.Data) != "hello" {
+		t.Fatalf("messages encrypted with the old key must still be decrypted: %v", err)
+	}
+
+	msg = &nats.Msg{Data: []byte("hello")}
+	err = rotated.Encrypt(msg)
+	if err != nil || msg.Header.Get(HeaderKeyId) != "new" {
+		t.Fatalf("the new key must be used for encrypting: %v %+v", err, msg.Header)
+	}
+	_, err = old.Decrypt(msg)
+	if err == nil {
+		t.Fatalf("messages with an unknown key must not be decrypted")
+	}
+}
+
+func TestEncryptionNaClBoxPublicKey(t *testing.T) {
+	receiver := provisionedEncryption(t, &Encryption{
+		Algorithm: EncryptionNaClBox,
+		Keys:      map[string]*EncryptionKey{"k1": {Key: testKey(3)}},
+	})
+	publicKey := base64.StdEncoding.EncodeToString(receiver.Keys["k1"].public[:])
+	sender := provisionedEncryption(t, &Encryption{
+		Algorithm: EncryptionNaClBox,
+		Keys:      map[string]*EncryptionKey{"k1": {Key: publicKey, Public: true}},
+	})
+
+	msg := &nats.Msg{Data: []byte("hello")}
+	err := sender.Encrypt(msg)
+	if err != nil {
+		t.Fatalf("could not encrypt: %v", err)
+	}
+	decrypted, err := receiver.Decrypt(msg)
+	if err != nil || string(decrypted.Data) != "hello" {
+		t.Fatalf("could not decrypt with the private key: %v", err)
+	}
+	_, err = sender.Decrypt(msg)
+	if err == nil {
+		t.Fatalf("public keys must not be able to decrypt")
+	}
+}
+
+// TestEncryptionNaClBoxReplyKey checks that replies are encrypted with the public key of the requesting side; so
+// that it does not need the private key of the receiver.
+func TestEncryptionNaClBoxReplyKey(t *testing.T) {
+	receiverKey := provisionedEncryption(t, &Encryption{Algorithm: EncryptionNaClBox, Keys: map[string]*EncryptionKey{"svc": {Key: testKey(3)}}})
+	requesterKey := provisionedEncryption(t, &Encryption{Algorithm: EncryptionNaClBox, Keys: map[string]*EncryptionKey{"client": {Key: testKey(4)}}})
+	publicKey := func(e *Encryption, id string) string {
+		return base64.StdEncoding.EncodeToString(e.Keys[id].public[:])
+	}
+
+	receiver := provisionedEncryption(t, &Encryption{
+		Algorithm:  EncryptionNaClBox,
+		KeyID:      "svc",
+		ReplyKeyID: "client",
+		Keys: map[string]*EncryptionKey{
+			"svc":    {Key: testKey(3)},
+			"client": {Key: publicKey(requesterKey, "client"), Public: true},
+		},
+	})
+	requester := provisionedEncryption(t, &Encryption{
+		Algorithm: EncryptionNaClBox,
+		KeyID:     "svc",
+		Keys: map[string]*EncryptionKey{
+			"svc":    {Key: publicKey(receiverKey, "svc"), Public: true},
+			"client": {Key: testKey(4)},
+		},
+	})
+
+	request := &nats.Msg{Subject: "svc", Data: []byte("request")}
+	err := requester.Encrypt(request)
+	if err != nil {
+		t.Fatalf("could not encrypt request: %v", err)
+	}
+	if _, err := requester.Decrypt(request); err == nil {
+		t.Fatalf("the requesting side must not be able to decrypt requests")
+	}
+	if _, err := receiver.Decrypt(request); err != nil {
+		t.Fatalf("could not decrypt request: %v", err)
+	}
+
+	reply := &nats.Msg{Subject: "_INBOX.1", Data: []byte("reply")}
+	err = receiver.EncryptReply(reply)
+	if err != nil || reply.Header.Get(HeaderKeyId) != "client" {
+		t.Fatalf("reply must be encrypted with the reply key: %v %+v", err, reply.Header)
+	}
+	decrypted, err := requester.Decrypt(reply)
+	if err != nil || string(decrypted.Data) != "reply" {
+		t.Fatalf("could not decrypt reply: %v", err)
+	}
+
+	// without reply key, nacl-box replies are rejected.
+	err = receiverKey.EncryptReply(&nats.Msg{Subject: "_INBOX.2", Data: []byte("reply")})
+	if err == nil {
+		t.Fatalf("nacl-box replies without reply key must fail")
+	}
+}
+
+func TestEncryptionInvalidConfig(t *testing.T) {
+	for name, e := range map[string]*Encryption{
+		"unknown algorithm":  {Algorithm: "rot13", Keys: map[string]*EncryptionKey{"k1": {Key: testKey(1)}}},
+		"no keys":            {Algorithm: EncryptionAESGCM},
+		"unknown key id":     {Algorithm: EncryptionAESGCM, KeyID: "k2", Keys: map[string]*EncryptionKey{"k1": {Key: testKey(1)}}},
+		"unknown reply key":  {Algorithm: EncryptionAESGCM, ReplyKeyID: "k2", Keys: map[string]*EncryptionKey{"k1": {Key: testKey(1)}}},
+		"invalid key length": {Algorithm: EncryptionAESGCM, Keys: map[string]*EncryptionKey{"k1": {Key: "YWJj"}}},
+		"no base64":          {Algorithm: EncryptionNaClBox, Keys: map[string]*EncryptionKey{"k1": {Key: "not base64!"}}},
+	} {
+		if e.Provision() == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package common
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// HeaderPolicy controls which headers are transferred when converting between HTTP and NATS messages.
+// The steps are applied in this order:
+//
+//  1. Allow: if set, only headers matching one of the patterns are kept.
+//  2. Deny: headers matching one of the patterns are removed.
+//  3. Rename: headers are renamed (old name -> new name).
+//  4. Delete: headers matching one of the patterns are removed.
+//  5. Set: headers are set (replacing existing values).
+//  6. Add: header values are added.
+//
+// Patterns are case-insensitive header names; a trailing "*" matches all headers with the given prefix
+// (f.e. "X-Trace-*"). Values of Set and Add support placeholders.
+//
+// Headers added by the bridge itself (X-NatsBridge-*) are never removed by Allow and Deny.
+type HeaderPolicy struct {
+	Allow  []string          `json:"allow,omitempty"`
+	Deny   []string          `json:"deny,omitempty"`
+	Rename map[string]string `json:"rename,omitempty"`
+	Delete []string          `json:"delete,omitempty"`
+	Set    http.Header       `json:"set,omitempty"`
+	Add    http.Header       `json:"add,omitempty"`
+}
+
+const bridgeHeaderPrefix = "X-Natsbridge-"
+
+// Apply modifies the given headers according to the policy; a nil policy leaves them untouched.
+func (p *HeaderPolicy) Apply(header http.Header, repl *caddy.Replacer) {
+	if p == nil {
+		return
+	}
+
+	for name := range header {
+		if strings.HasPrefix(textproto.CanonicalMIMEHeaderKey(name), bridgeHeaderPrefix) {
+			continue
+		}
+		if len(p.Allow) > 0 && !matchesHeaderPattern(name, p.Allow) {
+			delete(header, name)
+			continue
+		}
+		if matchesHeaderPattern(name, p.Deny) {
+			delete(header, name)
+		}
+	}
+
+	for from, to := range p.Rename {
+		values := header.Values(from)
+		if len(values) == 0 {
+			continue
+		}
+		header.Del(from)
+		for _, v := range values {
+			header.Add(to, v)
+		}
+	}
+
+	if len(p.Delete) > 0 {
+		for name := range header {
+			if matchesHeaderPattern(name, p.Delete) {
+				delete(header, name)
+			}
+		}
+	}
+
+	for name, values := range p.Set {
+		header.Del(name)
+		for _, v := range values {
+			header.Add(name, repl.ReplaceAll(v, ""))
+		}
+	}
+	for name, values := range p.Add {
+		for _, v := range values {
+			header.Add(name, repl.ReplaceAll(v, ""))
+		}
+	}
+}
+
+func matchesHeaderPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(name, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// hopByHopHeaders are meaningful only for a single HTTP connection, so they must not be transferred via NATS
+// (see RFC 7230, section 6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopByHopHeaders removes the hop-by-hop headers, including the ones listed in the Connection header.
+func RemoveHopByHopHeaders(header http.Header) {
+	for _, connectionValue := range header.Values("Connection") {
+		for _, name := range strings.Split(connectionValue, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// ParseHeaderPolicy parses a header policy block. Syntax:
+//
+//	headers {
+//	    [allow name|pattern...]
+//	    [deny name|pattern...]
+//	    [rename from to]
+//	    [delete name|pattern...]
+//	    [set name value]
+//	    [add name value]
+//	}
+func ParseHeaderPolicy(d *caddyfile.Dispenser) (*HeaderPolicy, error) {
+	p := &HeaderPolicy{}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "allow", "deny", "delete":
+			directive := d.Val()
+			names := d.RemainingArgs()
+			if len(names) == 0 {
+				return nil, d.ArgErr()
+			}
+			switch directive {
+			case "allow":
+				p.Allow = append(p.Allow, names...)
+			case "deny":
+				p.Deny = append(p.Deny, names...)
+			default:
+				p.Delete = append(p.Delete, names...)
+			}
+		case "rename":
+			var from, to string
+			if !d.AllArgs(&from, &to) {
+				return nil, d.ArgErr()
+			}
+			if p.Rename == nil {
+				p.Rename = make(map[string]string)
+			}
+			p.Rename[from] = to
+		case "set", "add":
+			directive := d.Val()
+			var name, value string
+			if !d.AllArgs(&name, &value) {
+				return nil, d.ArgErr()
+			}
+			if directive == "set" {
+				if p.Set == nil {
+					p.Set = make(http.Header)
+				}
+				p.Set.Add(name, value)
+			} else {
+				if p.Add == nil {
+					p.Add = make(http.Header)
+				}
+				p.Add.Add(name, value)
+			}
+		default:
+			return nil, d.Errf("unrecognized headers subdirective: %s", d.Val())
+		}
+	}
+
+	return p, nil
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestHeaderPolicyApply(t *testing.T) {
+	type test struct {
+		description string
+		policy      *HeaderPolicy
+		input       http.Header
+		want        http.Header
+	}
+
+	tests := []test{
+		{
+			description: "nil policy keeps all headers",
+			policy:      nil,
+			input:       http.Header{"Cookie": {"a=b"}},
+			want:        http.Header{"Cookie": {"a=b"}},
+		},
+		{
+			description: "allow keeps only matching headers and the bridge headers",
+			policy:      &HeaderPolicy{Allow: []string{"x-trace-*", "Accept"}},
+			input:       http.Header{"Cookie": {"a=b"}, "Accept": {"*/*"}, "X-Trace-Id": {"1"}, "X-Natsbridge-Method": {"GET"}},
+			want:        http.Header{"Accept": {"*/*"}, "X-Trace-Id": {"1"}, "X-Natsbridge-Method": {"GET"}},
+		},
+		{
+			description: "deny removes matching headers, but never the bridge headers",
+			policy:      &HeaderPolicy{Deny: []string{"cookie", "X-*"}},
+			input:       http.Header{"Cookie": {"a=b"}, "Accept": {"*/*"}, "X-Trace-Id": {"1"}, "X-Natsbridge-Method": {"GET"}},
+			want:        http.Header{"Accept": {"*/*"}, "X-Natsbridge-Method": {"GET"}},
+		},
+		{
+			description: "rename happens before delete and set",
+			policy: &HeaderPolicy{
+				Rename: map[string]string{"X-Trace-Id": "X-Request-Id"},
+				Delete: []string{"X-Trace-*"},
+				Set:    http.Header{"X-Source": {"{test.value}"}},
+			},
+			input: http.Header{"X-Trace-Id": {"1"}, "X-Trace-Parent": {"2"}, "X-Source": {"client"}},
+			want:  http.Header{"X-Request-Id": {"1"}, "X-Source": {"replaced"}},
+		},
+		{
+			description: "add appends values",
+			policy:      &HeaderPolicy{Add: http.Header{"Via": {"caddy"}}},
+			input:       http.Header{"Via": {"proxy"}},
+			want:        http.Header{"Via": {"proxy", "caddy"}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			repl := caddy.NewReplacer()
+			repl.Set("test.value", "replaced")
+
+			tc.policy.Apply(tc.input, repl)
+			if !reflect.DeepEqual(tc.input, tc.want) {
+				t.Fatalf("got %+v, want %+v", tc.input, tc.want)
+			}
+		})
+	}
+}
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	header := http.Header{
+		"Connection":        {"keep-alive, X-Custom-Hop"},
+		"Keep-Alive":        {"timeout=5"},
+		"Transfer-Encoding": {"chunked"},
+		"X-Custom-Hop":      {"1"},
+		"Accept":            {"*/*"},
+	}
+	RemoveHopByHopHeaders(header)
+
+	want := http.Header{"Accept": {"*/*"}}
+	if !reflect.DeepEqual(header, want) {
+		t.Fatalf("got %+v, want %+v", header, want)
+	}
+}
@@ -6,15 +6,28 @@ import (
 	"net/http"
 )
 
+// Headers describing the original HTTP request of a NATS message created by NatsMsgForHttpRequest.
+const (
+	HeaderMethod   = "X-NatsBridge-Method"
+	HeaderUrlPath  = "X-NatsBridge-UrlPath"
+	HeaderUrlQuery = "X-NatsBridge-UrlQuery"
+)
+
 // NatsMsgForHttpRequest creates a nats.Msg from an existing http.Request: the HTTP Request Body is transferred
 // to the NATS message Data, and the headers are transferred as well.
 //
-// Three special headers are added for the request method, URL path, and raw query.
+// Three special headers are added for the request method, URL path, and raw query. Hop-by-hop headers are not
+// transferred.
 func NatsMsgForHttpRequest(r *http.Request, subject string) (*nats.Msg, error) {
 	var msg *nats.Msg
 	b, _ := io.ReadAll(r.Body)
 
-	headers := nats.Header(r.Header)
+	// cloned, so that the headers of the HTTP request stay untouched (f.e. for the next handlers of nats_publish).
+	headers := nats.Header(r.Header.Clone())
+	if headers == nil {
+		headers = nats.Header{}
+	}
+	RemoveHopByHopHeaders(http.Header(headers))
 	for k, v := range ExtraNatsMsgHeadersFromContext(r.Context()) {
 		headers.Add(k, v)
 	}
@@ -24,8 +37,8 @@ func NatsMsgForHttpRequest(r *http.Request, subject string) (*nats.Msg, error) {
 		Data:    b,
 	}
 
-	msg.Header.Add("X-NatsBridge-Method", r.Method)
-	msg.Header.Add("X-NatsBridge-UrlPath", r.URL.Path)
-	msg.Header.Add("X-NatsBridge-UrlQuery", r.URL.RawQuery)
+	msg.Header.Add(HeaderMethod, r.Method)
+	msg.Header.Add(HeaderUrlPath, r.URL.Path)
+	msg.Header.Add(HeaderUrlQuery, r.URL.RawQuery)
 	return msg, nil
 }
@@ -0,0 +1,40 @@
+package common
+
+import (
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/nats-io/nats.go"
+	"net/http"
+)
+
+// MessageFormat defines how HTTP requests are represented as NATS messages. Implementations are Caddy modules in
+// the nats.formats namespace.
+//
+// Both methods convert from/to the "raw" representation created by NatsMsgForHttpRequest: the HTTP headers
+// (including the X-NatsBridge-* headers) as message headers, and the HTTP body as message data.
+type MessageFormat interface {
+	// Encode converts a raw message into the wire format; r is the HTTP request the message was created from.
+	Encode(msg *nats.Msg, r *http.Request, repl *caddy.Replacer) (*nats.Msg, error)
+	// Decode converts a message in the wire format back into the raw representation; subject, reply subject and
+	// subscription of the message are kept.
+	Decode(msg *nats.Msg) (*nats.Msg, error)
+}
+
+// ParseMessageFormat parses the format subdirective into the JSON config of the format module. Syntax:
+//
+//	format raw|json|cloudevents [{
+//	    # options of the format module
+//	}]
+func ParseMessageFormat(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	name := d.Val()
+	unm, err := caddyfile.UnmarshalModule(d, "nats.formats."+name)
+	if err != nil {
+		return nil, err
+	}
+	return caddyconfig.JSONModuleObject(unm, "format", name, nil), nil
+}
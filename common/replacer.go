@@ -1,10 +1,12 @@
 package common
 
 import (
+	"encoding/json"
 	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/nats-io/nats.go"
@@ -39,6 +41,12 @@ func AddNATSPublishVarsToReplacer(repl *caddy.Replacer, req *http.Request) {
 }
 
 func AddNatsSubscribeVarsToReplacer(repl *caddy.Replacer, msg *nats.Msg) {
+	// parsed lazily, only if a JSON or JetStream placeholder is used.
+	var body any
+	var bodyParsed bool
+	var jsMeta *nats.MsgMetadata
+	var jsMetaParsed bool
+
 	natsVars := func(key string) (any, bool) {
 		if msg != nil {
 			switch key {
@@ -47,6 +55,18 @@ func AddNatsSubscribeVarsToReplacer(repl *caddy.Replacer, msg *nats.Msg) {
 			// generated nats path
 			case "nats.request.subject.asUriPath":
 				return strings.ReplaceAll(msg.Subject, ".", "/"), true
+			case "nats.request.reply":
+				return msg.Reply, true
+			case "nats.request.size":
+				return len(msg.Data), true
+
+			// original HTTP request, if the message was sent by nats_request or nats_publish
+			case "nats.request.method":
+				return msg.Header.Get(HeaderMethod), true
+			case "nats.request.path":
+				return msg.Header.Get(HeaderUrlPath), true
+			case "nats.request.query":
+				return msg.Header.Get(HeaderUrlQuery), true
 			}
 
 			if prefix := "nats.request.subject.asUriPath."; strings.HasPrefix(key, prefix) {
@@ -70,6 +90,44 @@ func AddNatsSubscribeVarsToReplacer(repl *caddy.Replacer, msg *nats.Msg) {
 				headerName := key[len(prefix):]
 				return msg.Header.Get(headerName), true
 			}
+
+			// fields of a JSON payload, f.e. {nats.request.body.json.items.0.id}
+			if prefix := "nats.request.body.json."; strings.HasPrefix(key, prefix) {
+				if !bodyParsed {
+					bodyParsed = true
+					if err := json.Unmarshal(msg.Data, &body); err != nil {
+						body = nil
+					}
+				}
+				return jsonPathValue(body, strings.Split(key[len(prefix):], "."))
+			}
+
+			// metadata of JetStream deliveries
+			if prefix := "nats.request.jetstream."; strings.HasPrefix(key, prefix) {
+				if !jsMetaParsed {
+					jsMetaParsed = true
+					jsMeta, _ = msg.Metadata()
+				}
+				if jsMeta == nil {
+					return "", true
+				}
+				switch key[len(prefix):] {
+				case "stream":
+					return jsMeta.Stream, true
+				case "consumer":
+					return jsMeta.Consumer, true
+				case "sequence.stream":
+					return jsMeta.Sequence.Stream, true
+				case "sequence.consumer":
+					return jsMeta.Sequence.Consumer, true
+				case "delivered":
+					return jsMeta.NumDelivered, true
+				case "pending":
+					return jsMeta.NumPending, true
+				case "timestamp":
+					return jsMeta.Timestamp.UTC().Format(time.RFC3339Nano), true
+				}
+			}
 		}
 
 		return nil, false
@@ -78,6 +136,42 @@ func AddNatsSubscribeVarsToReplacer(repl *caddy.Replacer, msg *nats.Msg) {
 	repl.Map(natsVars)
 }
 
+// jsonPathValue returns the value at the given path (object keys or array indexes) of a decoded JSON value.
+// Strings, numbers and booleans are returned as is; objects and arrays as JSON.
+func jsonPathValue(value any, path []string) (any, bool) {
+	for _, segment := range path {
+		switch v := value.(type) {
+		case map[string]any:
+			var ok bool
+			value, ok = v[segment]
+			if !ok {
+				return "", true
+			}
+		case []any:
+			idx, err := strconv.Atoi(segment)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return "", true
+			}
+			value = v[idx]
+		default:
+			return "", true
+		}
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return "", true
+	case map[string]any, []any:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", true
+		}
+		return string(b), true
+	default:
+		return v, true
+	}
+}
+
 // subSlice returns a subslice of the given slice based off the string exp.
 // expressions can be in the format of ":" "n", "n:", ":n", or "n:n", with n
 // being a valid integer
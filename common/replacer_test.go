@@ -113,3 +113,68 @@ func TestAddNatsSubscribeVarsToReplacer(t *testing.T) {
 		}
 	}
 }
+
+func TestAddNatsSubscribeVarsToReplacerMessageProperties(t *testing.T) {
+	type test struct {
+		msg *nats.Msg
+
+		input string
+		want  string
+	}
+
+	msgWith := func(reply string, data string, header nats.Header) *nats.Msg {
+		msg := nats.NewMsg("foo.bar")
+		msg.Reply = reply
+		msg.Data = []byte(data)
+		for k, v := range header {
+			msg.Header[k] = v
+		}
+		return msg
+	}
+	jsonBody := `{"user": {"id": 42, "name": "jane", "admin": false}, "items": [{"id": "a"}, {"id": "b"}], "ratio": 0.5}`
+	httpHeaders := nats.Header{
+		"X-NatsBridge-Method":   []string{"PUT"},
+		"X-NatsBridge-UrlPath":  []string{"/api/x"},
+		"X-NatsBridge-UrlQuery": []string{"a=1"},
+	}
+	// $JS.ACK.<stream>.<consumer>.<delivered>.<stream seq>.<consumer seq>.<timestamp>.<pending>
+	jsMsg := msgWith("$JS.ACK.ORDERS.worker.2.100.7.1700000000000000000.5", "", nil)
+	jsMsg.Sub = &nats.Subscription{}
+
+	tests := []test{
+		// message properties
+		{msg: msgWith("_INBOX.abc", "", nil), input: "{nats.request.reply}", want: "_INBOX.abc"},
+		{msg: msgWith("", "12345", nil), input: "{nats.request.size}", want: "5"},
+
+		// original HTTP request
+		{msg: msgWith("", "", httpHeaders), input: "{nats.request.method} {nats.request.path}?{nats.request.query}", want: "PUT /api/x?a=1"},
+		{msg: msgWith("", "", nil), input: "{nats.request.method}", want: ""},
+
+		// JSON payload
+		{msg: msgWith("", jsonBody, nil), input: "/users/{nats.request.body.json.user.id}", want: "/users/42"},
+		{msg: msgWith("", jsonBody, nil), input: "{nats.request.body.json.user.name}", want: "jane"},
+		{msg: msgWith("", jsonBody, nil), input: "{nats.request.body.json.user.admin}", want: "false"},
+		{msg: msgWith("", jsonBody, nil), input: "{nats.request.body.json.ratio}", want: "0.5"},
+		{msg: msgWith("", jsonBody, nil), input: "{nats.request.body.json.items.1.id}", want: "b"},
+		{msg: msgWith("", jsonBody, nil), input: "{nats.request.body.json.items.0}", want: `{"id":"a"}`},
+		{msg: msgWith("", jsonBody, nil), input: "{nats.request.body.json.items.5.id}", want: ""},
+		{msg: msgWith("", jsonBody, nil), input: "{nats.request.body.json.unknown}", want: ""},
+		{msg: msgWith("", "no json", nil), input: "{nats.request.body.json.user.id}", want: ""},
+
+		// JetStream metadata
+		{msg: jsMsg, input: "{nats.request.jetstream.stream}/{nats.request.jetstream.consumer}", want: "ORDERS/worker"},
+		{msg: jsMsg, input: "{nats.request.jetstream.sequence.stream}-{nats.request.jetstream.sequence.consumer}", want: "100-7"},
+		{msg: jsMsg, input: "{nats.request.jetstream.delivered} {nats.request.jetstream.pending}", want: "2 5"},
+		{msg: jsMsg, input: "{nats.request.jetstream.timestamp}", want: "2023-11-14T22:13:20Z"},
+		{msg: msgWith("_INBOX.abc", "", nil), input: "{nats.request.jetstream.stream}", want: ""},
+	}
+
+	for _, tc := range tests {
+		repl := caddy.NewReplacer()
+		AddNatsSubscribeVarsToReplacer(repl, tc.msg)
+		got := repl.ReplaceAll(tc.input, "")
+		if !reflect.DeepEqual(tc.want, got) {
+			t.Errorf("expected: %v, got: %v. Input: %s", tc.want, got, tc.input)
+		}
+	}
+}
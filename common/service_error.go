@@ -0,0 +1,22 @@
+package common
+
+import (
+	"github.com/nats-io/nats.go"
+	"strconv"
+)
+
+// the headers used by NATS micro services to signal errors to the requester.
+const (
+	HeaderServiceError     = "Nats-Service-Error"
+	HeaderServiceErrorCode = "Nats-Service-Error-Code"
+)
+
+// ServiceError returns status code and description of a service error reply; ok is false if the message is no
+// service error (or has no valid HTTP error status code).
+func ServiceError(msg *nats.Msg) (statusCode int, description string, ok bool) {
+	statusCode, err := strconv.Atoi(msg.Header.Get(HeaderServiceErrorCode))
+	if err != nil || statusCode < 400 || statusCode > 599 {
+		return 0, "", false
+	}
+	return statusCode, msg.Header.Get(HeaderServiceError), true
+}
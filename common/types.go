@@ -1,8 +1,28 @@
 package common
 
-import "github.com/nats-io/nats.go"
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+)
 
 type NatsHandler interface {
 	Subscribe(conn *nats.Conn) error
+	// Unsubscribe stops accepting new messages; messages which were already received are still handled.
 	Unsubscribe(conn *nats.Conn) error
+	// Wait blocks until all in-flight messages are handled (after Unsubscribe), or until ctx is done.
+	Wait(ctx context.Context) error
+}
+
+// NatsHandlerWithSubscription is implemented by handlers which expose their NATS subscription,
+// f.e. for introspection via the admin API.
+type NatsHandlerWithSubscription interface {
+	Subscription() *nats.Subscription
+}
+
+// NatsHandlerWithDependencies is implemented by handlers which depend on other Caddy apps. These must not be loaded
+// during Provision: the other apps might load the NATS app themselves, which leads to provisioning cycles. So the NATS
+// app resolves the dependencies of all handlers at the beginning of Start(), before anything is started; this way,
+// configuration errors are reported before any connection is opened.
+type NatsHandlerWithDependencies interface {
+	ResolveDependencies() error
 }
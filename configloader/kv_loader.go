@@ -0,0 +1,274 @@
+package configloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/nats-io/nats.go"
+	"github.com/sandstorm/caddy-nats-bridge/natsbridge"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+)
+
+// KeyValueLoader loads the Caddy config from a key of a JetStream KV bucket, and applies every new revision of the
+// key; so a single KV put reconfigures all Caddy instances watching it. It is configured as admin.config.load.
+//
+// Each revision is adapted (if an adapter is configured) and validated before it is applied. If validation fails, or
+// the config cannot be started, Caddy keeps running the last good revision, and the next revision is tried again.
+//
+// Unless the loaded config configures its own config loader, this loader is added to it, so that the new config keeps
+// watching the key. The loaded config must configure the NATS server alias of the loader.
+type KeyValueLoader struct {
+	Bucket      string `json:"bucket,omitempty"`
+	Key         string `json:"key,omitempty"`
+	ServerAlias string `json:"serverAlias,omitempty"`
+	// config adapter for the value, f.e. caddyfile; the value must be Caddy JSON if not set.
+	Adapter string `json:"adapter,omitempty"`
+
+	logger *zap.Logger
+	// set once this instance watches the key; see LoadConfig.
+	watching *atomic.Bool
+}
+
+// configRevision is a loaded and prepared config.
+type configRevision struct {
+	bucket   string
+	key      string
+	revision uint64
+	config   []byte
+}
+
+// current is the config revision running (or being applied). Caddy creates a new loader on every config change, so
+// this is shared between all instances.
+var (
+	currentMu sync.Mutex
+	current   *configRevision
+)
+
+func (KeyValueLoader) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "caddy.config_loaders.nats_kv",
+		New: func() caddy.Module {
+			// Default values
+			return &KeyValueLoader{
+				ServerAlias: "default",
+			}
+		},
+	}
+}
+
+func (l *KeyValueLoader) Provision(ctx caddy.Context) error {
+	l.logger = ctx.Logger(l)
+	l.watching = &atomic.Bool{}
+
+	if l.Bucket == "" || l.Key == "" {
+		return fmt.Errorf("bucket and key are required")
+	}
+	if l.Adapter != "" && caddyconfig.GetAdapter(l.Adapter) == nil {
+		return fmt.Errorf("unrecognized config adapter: %s", l.Adapter)
+	}
+	return nil
+}
+
+// LoadConfig returns the config to run. Directly after Caddy started, this is the latest revision of the key, which
+// replaces the bootstrap config; afterwards, it is the revision which is already running, so Caddy keeps it.
+//
+// In both cases, the key is watched in the background until this config is stopped; new revisions are applied from
+// there. LoadConfig is called synchronously while the config is started, so it must not block, and it must not fail
+// once a config from the bucket runs.
+func (l *KeyValueLoader) LoadConfig(ctx caddy.Context) ([]byte, error) {
+	if l.watching.Load() {
+		// called again by Caddy if load_delay is configured, because the returned config was running already. Updates
+		// are applied by the watcher, so there is nothing to do until this config is stopped.
+		<-ctx.Done()
+		return nil, nil
+	}
+
+	rev := l.current()
+	if rev == nil {
+		store, err := l.keyValue(ctx)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := store.Get(l.Key)
+		if err != nil {
+			return nil, fmt.Errorf("could not load config from KV bucket %s, key %s: %w", l.Bucket, l.Key, err)
+		}
+		config, err := l.prepare(entry.Value())
+		if err != nil {
+			return nil, fmt.Errorf("invalid config revision %d: %w", entry.Revision(), err)
+		}
+		rev = &configRevision{bucket: l.Bucket, key: l.Key, revision: entry.Revision(), config: config}
+		setCurrent(rev)
+		l.logger.Info("loaded config", zap.String("bucket", l.Bucket), zap.String("key", l.Key), zap.Uint64("revision", rev.revision))
+	}
+
+	l.watching.Store(true)
+	go l.watch(ctx, rev.revision)
+	return rev.config, nil
+}
+
+// watch applies all revisions of the key newer than after, until one is running (then, the loader of the new config
+// takes over) or ctx is done.
+func (l *KeyValueLoader) watch(ctx caddy.Context, after uint64) {
+	store, err := l.keyValue(ctx)
+	var watcher nats.KeyWatcher
+	if err == nil {
+		watcher, err = store.Watch(l.Key, nats.Context(ctx))
+	}
+	if err != nil {
+		l.logger.Error("cannot watch config key, new revisions are not applied", zap.String("bucket", l.Bucket), zap.String("key", l.Key), zap.Error(err))
+		return
+	}
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				return
+			}
+			// nil marks the end of the initial values.
+			if entry == nil || entry.Revision() <= after {
+				continue
+			}
+			if entry.Operation() != nats.KeyValuePut {
+				l.logger.Warn("config key was deleted, keeping the current config", zap.String("bucket", l.Bucket), zap.String("key", l.Key))
+				continue
+			}
+			if l.apply(ctx, entry) {
+				return
+			}
+		}
+	}
+}
+
+// apply validates and runs the config revision; it returns whether the config of ctx was replaced by it.
+func (l *KeyValueLoader) apply(ctx caddy.Context, entry nats.KeyValueEntry) bool {
+	logger := l.logger.With(zap.String("bucket", l.Bucket), zap.String("key", l.Key), zap.Uint64("revision", entry.Revision()))
+	config, err := l.prepare(entry.Value())
+	if err != nil {
+		logger.Error("invalid config revision, keeping the current config", zap.Error(err))
+		return false
+	}
+
+	lastGood := l.current()
+	setCurrent(&configRevision{bucket: l.Bucket, key: l.Key, revision: entry.Revision(), config: config})
+	logger.Info("applying config revision")
+	err = caddy.Load(config, false)
+	if err != nil {
+		// Caddy keeps running the previous config if the new one cannot be started.
+		setCurrent(lastGood)
+		if lastGood != nil {
+			logger = logger.With(zap.Uint64("lastGoodRevision", lastGood.revision))
+		}
+		logger.Error("could not apply config revision, rolled back to the last good config", zap.Error(err))
+		return false
+	}
+	// on success, the config of ctx is stopped synchronously.
+	if ctx.Err() == nil {
+		// Caddy does not reload an unchanged config (f.e. if the same value was put again), so this loader keeps
+		// watching; the revision is current nevertheless.
+		logger.Info("config revision is unchanged, keeping the running config")
+		return false
+	}
+	return true
+}
+
+// prepare adapts and validates a config value, and adds this loader to it if it has no config loader itself.
+func (l *KeyValueLoader) prepare(value []byte) ([]byte, error) {
+	config := value
+	if l.Adapter != "" {
+		var warnings []caddyconfig.Warning
+		var err error
+		config, warnings, err = caddyconfig.GetAdapter(l.Adapter).Adapt(value, nil)
+		if err != nil {
+			return nil, fmt.Errorf("adapting config with %s: %w", l.Adapter, err)
+		}
+		for _, warning := range warnings {
+			l.logger.Warn(warning.String())
+		}
+	}
+
+	var raw map[string]any
+	err := json.Unmarshal(config, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("config is not valid JSON: %w", err)
+	}
+	admin := childMap(raw, "admin")
+	adminConfig := childMap(admin, "config")
+	if adminConfig["load"] == nil {
+		adminConfig["load"] = caddyconfig.JSONModuleObject(l, "module", "nats_kv", nil)
+		if _, ok := childMap(childMap(childMap(raw, "apps"), "nats"), "servers")[l.ServerAlias]; !ok {
+			return nil, fmt.Errorf("NATS server alias %s must be configured, to keep watching the config", l.ServerAlias)
+		}
+	}
+	config, err = json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg *caddy.Config
+	err = caddy.StrictUnmarshalJSON(caddy.RemoveMetaFields(config), &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("decoding config: %w", err)
+	}
+	err = caddy.Validate(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("validating config: %w", err)
+	}
+	return config, nil
+}
+
+// keyValue loads the KV bucket via the connection of the NATS app of ctx. It is not cached, as every config (and thus
+// every loader instance) has its own NATS connection.
+func (l *KeyValueLoader) keyValue(ctx caddy.Context) (nats.KeyValue, error) {
+	conn, err := natsbridge.ServerConn(ctx, l.ServerAlias)
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("could not load JetStream: %w", err)
+	}
+	store, err := js.KeyValue(l.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("could not load KV bucket %s: %w", l.Bucket, err)
+	}
+	return store, nil
+}
+
+// current returns the running config revision, if it was loaded from the key of this loader.
+func (l *KeyValueLoader) current() *configRevision {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	if current == nil || current.bucket != l.Bucket || current.key != l.Key {
+		return nil
+	}
+	return current
+}
+
+func setCurrent(rev *configRevision) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	current = rev
+}
+
+// childMap returns m[key] as map; it is created if missing.
+func childMap(m map[string]any, key string) map[string]any {
+	child, ok := m[key].(map[string]any)
+	if !ok {
+		child = map[string]any{}
+		m[key] = child
+	}
+	return child
+}
+
+var (
+	_ caddy.Provisioner  = (*KeyValueLoader)(nil)
+	_ caddy.ConfigLoader = (*KeyValueLoader)(nil)
+)
@@ -0,0 +1,121 @@
+package configloader_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/nats-io/nats.go"
+	_ "github.com/sandstorm/caddy-nats-bridge"
+	"github.com/sandstorm/caddy-nats-bridge/integrationtest"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// siteConfig returns a Caddyfile with the given site block.
+func siteConfig(port int, directive string) string {
+	return fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:%d {
+			%s
+		}
+	`, "", port, directive)
+}
+
+// TestKeyValueLoader checks that the config is loaded from the KV bucket, new revisions are applied, and invalid or
+// failing revisions are skipped, keeping the last good config.
+func TestKeyValueLoader(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	js := tn.ResetJetStream(t)
+	store, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "caddy"})
+	integrationtest.FailOnErr("could not create KV bucket: %s", err, t)
+	_, err = store.PutString("edge", siteConfig(8889, `respond "revision 1"`))
+	integrationtest.FailOnErr("could not put config: %s", err, t)
+
+	bootstrap := siteConfig(8889, `respond "bootstrap"`)
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(bootstrap, "caddyfile")
+
+	// the Caddyfile cannot configure config loaders, so it is added to the adapted bootstrap config.
+	adapted, _, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(bootstrap), nil)
+	integrationtest.FailOnErr("could not adapt bootstrap config: %s", err, t)
+	var cfg map[string]any
+	integrationtest.FailOnErr("invalid bootstrap config: %s", json.Unmarshal(adapted, &cfg), t)
+	cfg["admin"].(map[string]any)["config"] = map[string]any{
+		"load": map[string]any{"module": "nats_kv", "bucket": "caddy", "key": "edge", "adapter": "caddyfile"},
+	}
+	body, err := json.Marshal(cfg)
+	integrationtest.FailOnErr("could not encode bootstrap config: %s", err, t)
+	res, err := http.Post("http://localhost:2999/load", "application/json", strings.NewReader(string(body)))
+	integrationtest.FailOnErr("could not load bootstrap config: %s", err, t)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("could not load bootstrap config: status %d", res.StatusCode)
+	}
+
+	assertBody := func(t *testing.T, expected string, wait time.Duration) {
+		var actual string
+		for deadline := time.Now().Add(wait); ; {
+			res, err := http.Get("http://localhost:8889/")
+			if err == nil {
+				b, _ := io.ReadAll(res.Body)
+				res.Body.Close()
+				actual = string(b)
+			}
+			if actual == expected || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if actual != expected {
+			t.Fatalf("wrong response. Expected: %q. Actual: %q", expected, actual)
+		}
+	}
+
+	t.Run("initial revision replaces the bootstrap config", func(t *testing.T) {
+		assertBody(t, "revision 1", 5*time.Second)
+	})
+
+	t.Run("new revision is applied", func(t *testing.T) {
+		_, err := store.PutString("edge", siteConfig(8889, `respond "revision 2"`))
+		integrationtest.FailOnErr("could not put config: %s", err, t)
+		assertBody(t, "revision 2", 5*time.Second)
+	})
+
+	t.Run("invalid revision is skipped", func(t *testing.T) {
+		_, err := store.PutString("edge", siteConfig(8889, `unknown_directive`))
+		integrationtest.FailOnErr("could not put config: %s", err, t)
+		time.Sleep(500 * time.Millisecond)
+		assertBody(t, "revision 2", 0)
+	})
+
+	t.Run("revision which cannot be started is rolled back", func(t *testing.T) {
+		// the port is taken, so the config is valid but cannot be started. (It has no site on 8889, because Caddy does
+		// not stop the servers of a config which was started partially.)
+		listener, err := net.Listen("tcp", "127.0.0.1:8890")
+		integrationtest.FailOnErr("could not listen: %s", err, t)
+		defer listener.Close()
+
+		_, err = store.PutString("edge", siteConfig(8890, `respond "revision 4"`))
+		integrationtest.FailOnErr("could not put config: %s", err, t)
+		time.Sleep(500 * time.Millisecond)
+		assertBody(t, "revision 2", 0)
+
+		_, err = store.PutString("edge", siteConfig(8889, `respond "revision 5"`))
+		integrationtest.FailOnErr("could not put config: %s", err, t)
+		assertBody(t, "revision 5", 5*time.Second)
+	})
+
+	t.Run("unchanged revision keeps the config, and later revisions are applied", func(t *testing.T) {
+		_, err := store.PutString("edge", siteConfig(8889, `respond "revision 5"`))
+		integrationtest.FailOnErr("could not put config: %s", err, t)
+		time.Sleep(500 * time.Millisecond)
+		assertBody(t, "revision 5", 0)
+
+		_, err = store.PutString("edge", siteConfig(8889, `respond "revision 7"`))
+		integrationtest.FailOnErr("could not put config: %s", err, t)
+		assertBody(t, "revision 7", 5*time.Second)
+	})
+}
@@ -0,0 +1,34 @@
+package eventpublish
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// UnmarshalCaddyfile parses the nats_publish event handler. Syntax:
+//
+//	events {
+//	    on <event> nats_publish [serverAlias] subject
+//	}
+func (p *EventPublish) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.CountRemainingArgs() == 2 {
+			if !d.Args(&p.ServerAlias, &p.Subject) {
+				// should never fail because of the check above for remainingArgs==2
+				return d.Errf("Wrong argument count or unexpected line ending after '%s'", d.Val())
+			}
+		} else {
+			if !d.Args(&p.Subject) {
+				return d.Errf("Wrong argument count or unexpected line ending after '%s'", d.Val())
+			}
+		}
+
+		for d.NextBlock(0) {
+			switch d.Val() {
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+
+	return nil
+}
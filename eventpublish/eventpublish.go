@@ -0,0 +1,77 @@
+package eventpublish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/sandstorm/caddy-nats-bridge/natsbridge"
+	"go.uber.org/zap"
+)
+
+// EventPublish publishes Caddy events (f.e. cert_obtained, cert_failed) as JSON to a NATS subject.
+// The payload is the event in CloudEvents JSON format.
+type EventPublish struct {
+	// supports placeholders, f.e. caddy.events.{event.name}
+	Subject     string `json:"subject,omitempty"`
+	ServerAlias string `json:"serverAlias,omitempty"`
+
+	logger   *zap.Logger
+	caddyCtx caddy.Context
+}
+
+func (EventPublish) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "events.handlers.nats_publish",
+		New: func() caddy.Module {
+			// Default values
+			return &EventPublish{
+				ServerAlias: "default",
+			}
+		},
+	}
+}
+
+func (p *EventPublish) Provision(ctx caddy.Context) error {
+	p.logger = ctx.Logger(p)
+	// NOTE: we cannot fetch the NATS app here, because the events app is provisioned by the NATS app itself
+	// (to emit the connection events) - this would be a provisioning cycle. So we look up the connection lazily
+	// in Handle().
+	p.caddyCtx = ctx
+
+	return nil
+}
+
+func (p *EventPublish) Handle(ctx context.Context, e caddyevents.Event) error {
+	repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		repl = caddy.NewReplacer()
+	}
+	subj := repl.ReplaceAll(p.Subject, "")
+
+	conn, err := natsbridge.ServerConn(p.caddyCtx, p.ServerAlias)
+	if err != nil {
+		return err
+	}
+
+	ce := e.CloudEvent()
+	data, err := json.Marshal(ce)
+	if err != nil {
+		return fmt.Errorf("could not encode event %s: %w", ce.Type, err)
+	}
+
+	p.logger.Debug("publishing Caddy event to NATS", zap.String("event", ce.Type), zap.String("subject", subj))
+	err = conn.Publish(subj, data)
+	if err != nil {
+		return fmt.Errorf("could not publish event %s to NATS: %w", ce.Type, err)
+	}
+	return nil
+}
+
+var (
+	_ caddyevents.Handler   = (*EventPublish)(nil)
+	_ caddy.Provisioner     = (*EventPublish)(nil)
+	_ caddyfile.Unmarshaler = (*EventPublish)(nil)
+)
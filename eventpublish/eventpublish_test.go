@@ -0,0 +1,62 @@
+package eventpublish_test
+
+import (
+	"encoding/json"
+	_ "github.com/sandstorm/caddy-nats-bridge"
+	"github.com/sandstorm/caddy-nats-bridge/integrationtest"
+	"testing"
+	"time"
+)
+
+// TestCaddyEventsToNats publishes Caddy events to NATS. We use the nats.connected event
+// (emitted by the NATS app itself), because it is triggered reliably on startup.
+//
+//	┌──────────────┐   ┌──────────────┐
+//	│ Caddy events │──▶│ nats_publish │──────────▶ caddy.events.nats.connected
+//	└──────────────┘   └──────────────┘
+func TestCaddyEventsToNats(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+
+	subscription, err := tn.ClientConn.SubscribeSync("caddy.events.>")
+	integrationtest.FailOnErr("error subscribing to caddy.events.>: %w", err, t)
+	defer subscription.Unsubscribe()
+
+	// the events global option must be part of the global options block, so we cannot use DefaultCaddyConf here.
+	caddyTester.InitServer(`
+		{
+			default_bind 127.0.0.1
+			http_port 8889
+			admin 127.0.0.1:2999
+			nats {
+				url 127.0.0.1:8369
+			}
+			events {
+				on nats.connected nats_publish caddy.events.{event.name}
+			}
+		}
+		:8889 {
+			respond 200
+		}
+	`, "caddyfile")
+
+	msg, err := subscription.NextMsg(1 * time.Second)
+	integrationtest.FailOnErr("message not received: %v", err, t)
+
+	if msg.Subject != "caddy.events.nats.connected" {
+		t.Fatalf("Subject not correct, expected 'caddy.events.nats.connected', actual: %s", msg.Subject)
+	}
+	var ce struct {
+		Type   string         `json:"type"`
+		Source string         `json:"source"`
+		Data   map[string]any `json:"data"`
+	}
+	err = json.Unmarshal(msg.Data, &ce)
+	integrationtest.FailOnErr("event is not valid JSON: %v", err, t)
+	if ce.Type != "nats.connected" {
+		t.Fatalf("event type not correct, expected 'nats.connected', actual: %s", ce.Type)
+	}
+	if ce.Data["server"] != "default" {
+		t.Fatalf("event data should contain the server alias, actual: %+v", ce.Data)
+	}
+}
@@ -0,0 +1,259 @@
+package format
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/sandstorm/caddy-nats-bridge/common"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// CloudEventsModeBinary transfers the event attributes as ce-* headers, and the HTTP body as message data.
+	CloudEventsModeBinary = "binary"
+	// CloudEventsModeStructured transfers the whole event (attributes and data) as JSON in the message data.
+	CloudEventsModeStructured = "structured"
+)
+
+// DefaultCloudEventsType is the event type used if no type is configured.
+const DefaultCloudEventsType = "caddy.nats.http_request"
+
+const cloudEventsContentType = "application/cloudevents+json"
+
+// CloudEvents encodes the HTTP request as CloudEvent (version 1.0), following the NATS protocol binding of the
+// CloudEvents spec.
+//
+// Decoding accepts both modes, and results in a request in the binary mode of the CloudEvents HTTP binding
+// (attributes as Ce-* headers, data as body); so HTTP handlers do not need to care about the mode.
+type CloudEvents struct {
+	// CloudEventsModeBinary (default) or CloudEventsModeStructured.
+	Mode string `json:"mode,omitempty"`
+	// the event type; supports placeholders. Defaults to DefaultCloudEventsType.
+	Type string `json:"type,omitempty"`
+	// the event source; supports placeholders. Defaults to the request URL (without query).
+	Source string `json:"source,omitempty"`
+}
+
+func (CloudEvents) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.formats.cloudevents",
+		New: func() caddy.Module { return new(CloudEvents) },
+	}
+}
+
+func (c *CloudEvents) Provision(_ caddy.Context) error {
+	switch c.Mode {
+	case "":
+		c.Mode = CloudEventsModeBinary
+	case CloudEventsModeBinary, CloudEventsModeStructured:
+	default:
+		return fmt.Errorf("cloudevents mode must be %s or %s, got: %s", CloudEventsModeBinary, CloudEventsModeStructured, c.Mode)
+	}
+	if c.Type == "" {
+		c.Type = DefaultCloudEventsType
+	}
+	return nil
+}
+
+func (c *CloudEvents) Encode(msg *nats.Msg, r *http.Request, repl *caddy.Replacer) (*nats.Msg, error) {
+	source := repl.ReplaceAll(c.Source, "")
+	if source == "" {
+		source = strings.SplitN(requestURL(msg, r), "?", 2)[0]
+	}
+	attributes := map[string]string{
+		"specversion": "1.0",
+		"id":          nuid.Next(),
+		"source":      source,
+		"type":        repl.ReplaceAll(c.Type, ""),
+		"time":        time.Now().UTC().Format(time.RFC3339Nano),
+	}
+
+	out := nats.NewMsg(msg.Subject)
+	for k, v := range msg.Header {
+		out.Header[k] = v
+	}
+
+	if c.Mode == CloudEventsModeBinary {
+		for name, value := range attributes {
+			out.Header.Set("ce-"+name, value)
+		}
+		out.Data = msg.Data
+		return out, nil
+	}
+
+	event := make(map[string]any, len(attributes)+2)
+	for name, value := range attributes {
+		event[name] = value
+	}
+	contentType := msg.Header.Get("Content-Type")
+	if contentType != "" {
+		event["datacontenttype"] = contentType
+	}
+	if len(msg.Data) > 0 {
+		if isJSONContentType(contentType) && json.Valid(msg.Data) {
+			event["data"] = json.RawMessage(msg.Data)
+		} else {
+			event["data_base64"] = base64.StdEncoding.EncodeToString(msg.Data)
+		}
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode CloudEvent: %w", err)
+	}
+	out.Header.Set("Content-Type", cloudEventsContentType)
+	out.Data = data
+	return out, nil
+}
+
+func (c *CloudEvents) Decode(msg *nats.Msg) (*nats.Msg, error) {
+	out := &nats.Msg{
+		Subject: msg.Subject,
+		Reply:   msg.Reply,
+		Sub:     msg.Sub,
+		Header:  nats.Header{},
+	}
+	for k, v := range msg.Header {
+		out.Header[k] = v
+	}
+
+	if !strings.HasPrefix(headerValue(msg.Header, "Content-Type"), cloudEventsContentType) {
+		if headerValue(msg.Header, "ce-specversion") == "" {
+			return nil, fmt.Errorf("message is no CloudEvent: neither ce-specversion header nor content type %s", cloudEventsContentType)
+		}
+		out.Data = msg.Data
+		return out, nil
+	}
+
+	var event map[string]json.RawMessage
+	err := json.Unmarshal(msg.Data, &event)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode CloudEvent: %w", err)
+	}
+	for _, required := range []string{"specversion", "id", "source", "type"} {
+		if _, ok := event[required]; !ok {
+			return nil, fmt.Errorf("CloudEvent is missing the required attribute %s", required)
+		}
+	}
+
+	deleteHeader(out.Header, "Content-Type")
+	var contentType string
+	for name, raw := range event {
+		var value string
+		if json.Unmarshal(raw, &value) != nil {
+			// extension attributes can also be numbers or booleans.
+			value = string(raw)
+		}
+		switch name {
+		case "data", "data_base64":
+		case "datacontenttype":
+			contentType = value
+			out.Header.Set("Content-Type", value)
+		default:
+			out.Header.Set("ce-"+name, value)
+		}
+	}
+
+	if raw, ok := event["data_base64"]; ok {
+		var encoded string
+		err = json.Unmarshal(raw, &encoded)
+		if err == nil {
+			out.Data, err = base64.StdEncoding.DecodeString(encoded)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid data_base64 in CloudEvent: %w", err)
+		}
+	} else if raw, ok := event["data"]; ok {
+		var text string
+		if !isJSONContentType(contentType) && json.Unmarshal(raw, &text) == nil {
+			// non-JSON data is transferred as JSON string.
+			out.Data = []byte(text)
+		} else {
+			out.Data = raw
+		}
+	}
+
+	return out, nil
+}
+
+// UnmarshalCaddyfile parses the cloudevents format. Syntax:
+//
+//	format cloudevents {
+//	    [mode binary|structured]
+//	    [type eventType]
+//	    [source eventSource]
+//	}
+func (c *CloudEvents) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume format name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "mode":
+			if !d.AllArgs(&c.Mode) {
+				return d.ArgErr()
+			}
+			if c.Mode != CloudEventsModeBinary && c.Mode != CloudEventsModeStructured {
+				return d.Errf("mode must be %s or %s, got: %s", CloudEventsModeBinary, CloudEventsModeStructured, c.Mode)
+			}
+		case "type":
+			if !d.AllArgs(&c.Type) {
+				return d.ArgErr()
+			}
+		case "source":
+			if !d.AllArgs(&c.Source) {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized cloudevents subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// isJSONContentType returns true for application/json and all media types with +json suffix; also for an empty
+// content type, which means JSON in the CloudEvents JSON format.
+func isJSONContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// headerValue returns the first value of the given header; case-insensitive, as the header names of NATS messages
+// are case-sensitive.
+func headerValue(header nats.Header, name string) string {
+	for k, v := range header {
+		if strings.EqualFold(k, name) && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+func deleteHeader(header nats.Header, name string) {
+	for k := range header {
+		if strings.EqualFold(k, name) {
+			delete(header, k)
+		}
+	}
+}
+
+var (
+	_ common.MessageFormat  = (*CloudEvents)(nil)
+	_ caddy.Provisioner     = (*CloudEvents)(nil)
+	_ caddyfile.Unmarshaler = (*CloudEvents)(nil)
+)
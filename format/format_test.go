@@ -0,0 +1,146 @@
+package format_test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/sandstorm/caddy-nats-bridge/common"
+	"github.com/sandstorm/caddy-nats-bridge/format"
+)
+
+func rawMsg(t *testing.T, contentType string, body string) *nats.Msg {
+	req := httptest.NewRequest("POST", "http://example.com/orders/42?expand=1", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Custom", "MyValue")
+	msg, err := common.NatsMsgForHttpRequest(req, "orders.42")
+	if err != nil {
+		t.Fatalf("could not create raw message: %v", err)
+	}
+	return msg
+}
+
+// roundTrip encodes and decodes a raw message; the result must be equivalent to the raw message.
+func roundTrip(t *testing.T, f common.MessageFormat, raw *nats.Msg) (encoded *nats.Msg, decoded *nats.Msg) {
+	req := httptest.NewRequest("POST", "http://example.com/orders/42?expand=1", nil)
+	encoded, err := f.Encode(raw, req, caddy.NewReplacer())
+	if err != nil {
+		t.Fatalf("could not encode: %v", err)
+	}
+	decoded, err = f.Decode(encoded)
+	if err != nil {
+		t.Fatalf("could not decode: %v", err)
+	}
+
+	if string(decoded.Data) != string(raw.Data) {
+		t.Fatalf("body not restored. Expected: %q. Actual: %q", raw.Data, decoded.Data)
+	}
+	for _, h := range []string{common.HeaderMethod, common.HeaderUrlPath, common.HeaderUrlQuery, "X-Custom", "Content-Type"} {
+		if decoded.Header.Get(h) != raw.Header.Get(h) {
+			t.Fatalf("header %s not restored. Expected: %q. Actual headers: %+v", h, raw.Header.Get(h), decoded.Header)
+		}
+	}
+	return encoded, decoded
+}
+
+func TestJSONFormat(t *testing.T) {
+	encoded, _ := roundTrip(t, &format.JSON{}, rawMsg(t, "text/plain", "Hello World"))
+
+	var env format.Envelope
+	err := json.Unmarshal(encoded.Data, &env)
+	if err != nil {
+		t.Fatalf("message data is no JSON envelope: %v", err)
+	}
+	if env.Method != "POST" || env.URL != "http://example.com/orders/42?expand=1" || string(env.Body) != "Hello World" {
+		t.Fatalf("wrong envelope: %+v", env)
+	}
+	if env.Headers.Get(common.HeaderMethod) != "" {
+		t.Fatalf("X-NatsBridge headers should not be part of the envelope headers: %+v", env.Headers)
+	}
+	if !strings.Contains(string(encoded.Data), `"body":"SGVsbG8gV29ybGQ="`) {
+		t.Fatalf("body must be base64 encoded: %s", encoded.Data)
+	}
+}
+
+func TestCloudEventsFormat(t *testing.T) {
+	t.Run("binary mode", func(t *testing.T) {
+		f := &format.CloudEvents{Mode: format.CloudEventsModeBinary, Type: format.DefaultCloudEventsType}
+		encoded, _ := roundTrip(t, f, rawMsg(t, "application/json", `{"id": 42}`))
+
+		if encoded.Header.Get("ce-specversion") != "1.0" || encoded.Header.Get("ce-type") != format.DefaultCloudEventsType {
+			t.Fatalf("wrong ce-* headers: %+v", encoded.Header)
+		}
+		if encoded.Header.Get("ce-source") != "http://example.com/orders/42" || encoded.Header.Get("ce-id") == "" {
+			t.Fatalf("wrong ce-* headers: %+v", encoded.Header)
+		}
+		if string(encoded.Data) != `{"id": 42}` {
+			t.Fatalf("data must be the HTTP body in binary mode: %s", encoded.Data)
+		}
+	})
+
+	t.Run("structured mode with JSON data", func(t *testing.T) {
+		f := &format.CloudEvents{Mode: format.CloudEventsModeStructured, Type: "order.created"}
+		encoded, decoded := roundTrip(t, f, rawMsg(t, "application/json", `{"id":42}`))
+
+		if encoded.Header.Get("Content-Type") != "application/cloudevents+json" {
+			t.Fatalf("wrong content type: %+v", encoded.Header)
+		}
+		var event map[string]any
+		err := json.Unmarshal(encoded.Data, &event)
+		if err != nil {
+			t.Fatalf("message data is no CloudEvent: %v", err)
+		}
+		if event["type"] != "order.created" || event["datacontenttype"] != "application/json" {
+			t.Fatalf("wrong CloudEvent: %s", encoded.Data)
+		}
+		if data, ok := event["data"].(map[string]any); !ok || data["id"] != float64(42) {
+			t.Fatalf("JSON data must be embedded as JSON: %s", encoded.Data)
+		}
+		if decoded.Header.Get("ce-type") != "order.created" {
+			t.Fatalf("attributes must be decoded to ce-* headers: %+v", decoded.Header)
+		}
+	})
+
+	t.Run("structured mode with binary data", func(t *testing.T) {
+		f := &format.CloudEvents{Mode: format.CloudEventsModeStructured, Type: format.DefaultCloudEventsType}
+		encoded, _ := roundTrip(t, f, rawMsg(t, "text/plain", "Hello World"))
+
+		if !strings.Contains(string(encoded.Data), `"data_base64":"SGVsbG8gV29ybGQ="`) {
+			t.Fatalf("non-JSON data must be base64 encoded: %s", encoded.Data)
+		}
+	})
+
+	t.Run("structured mode with string data", func(t *testing.T) {
+		f := &format.CloudEvents{}
+		msg := nats.NewMsg("orders.42")
+		msg.Header.Set("Content-Type", "application/cloudevents+json; charset=utf-8")
+		msg.Data = []byte(`{"specversion":"1.0","id":"1","source":"/orders","type":"order.created","datacontenttype":"text/plain","data":"Hello World"}`)
+
+		decoded, err := f.Decode(msg)
+		if err != nil {
+			t.Fatalf("could not decode: %v", err)
+		}
+		if string(decoded.Data) != "Hello World" || decoded.Header.Get("Content-Type") != "text/plain" {
+			t.Fatalf("wrong decoded message: %q %+v", decoded.Data, decoded.Header)
+		}
+	})
+
+	t.Run("messages which are no CloudEvents are rejected", func(t *testing.T) {
+		f := &format.CloudEvents{}
+		_, err := f.Decode(rawMsg(t, "text/plain", "Hello World"))
+		if err == nil {
+			t.Fatalf("expected an error")
+		}
+
+		msg := nats.NewMsg("orders.42")
+		msg.Header.Set("Content-Type", "application/cloudevents+json")
+		msg.Data = []byte(`{"specversion":"1.0","id":"1"}`)
+		_, err = f.Decode(msg)
+		if err == nil || !strings.Contains(err.Error(), "source") {
+			t.Fatalf("expected an error about the missing source attribute, got: %v", err)
+		}
+	})
+}
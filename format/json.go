@@ -0,0 +1,119 @@
+package format
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/nats-io/nats.go"
+	"github.com/sandstorm/caddy-nats-bridge/common"
+	"net/http"
+	"net/url"
+)
+
+// Envelope is the message data of the json format.
+type Envelope struct {
+	Method string `json:"method"`
+	// the full URL of the request, including scheme, host and query.
+	URL     string      `json:"url"`
+	Headers http.Header `json:"headers,omitempty"`
+	// base64 encoded (standard encoding, with padding).
+	Body       []byte `json:"body,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+}
+
+// JSON wraps the whole HTTP request into a JSON Envelope; the message itself only has a Content-Type header.
+type JSON struct{}
+
+func (JSON) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.formats.json",
+		New: func() caddy.Module { return new(JSON) },
+	}
+}
+
+func (JSON) Encode(msg *nats.Msg, r *http.Request, _ *caddy.Replacer) (*nats.Msg, error) {
+	env := Envelope{
+		Method:     msg.Header.Get(common.HeaderMethod),
+		URL:        requestURL(msg, r),
+		Headers:    http.Header{},
+		Body:       msg.Data,
+		RemoteAddr: r.RemoteAddr,
+	}
+	for k, v := range msg.Header {
+		env.Headers[k] = v
+	}
+	// part of method and url already.
+	delete(env.Headers, common.HeaderMethod)
+	delete(env.Headers, common.HeaderUrlPath)
+	delete(env.Headers, common.HeaderUrlQuery)
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode JSON envelope: %w", err)
+	}
+	out := nats.NewMsg(msg.Subject)
+	out.Header.Set("Content-Type", "application/json")
+	out.Data = data
+	return out, nil
+}
+
+func (JSON) Decode(msg *nats.Msg) (*nats.Msg, error) {
+	var env Envelope
+	err := json.Unmarshal(msg.Data, &env)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode JSON envelope: %w", err)
+	}
+	u, err := url.Parse(env.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url in JSON envelope: %w", err)
+	}
+
+	header := nats.Header{}
+	for k, v := range env.Headers {
+		header[k] = v
+	}
+	if env.Method != "" {
+		header.Set(common.HeaderMethod, env.Method)
+	}
+	header.Set(common.HeaderUrlPath, u.Path)
+	header.Set(common.HeaderUrlQuery, u.RawQuery)
+
+	return &nats.Msg{
+		Subject: msg.Subject,
+		Reply:   msg.Reply,
+		Sub:     msg.Sub,
+		Header:  header,
+		Data:    env.Body,
+	}, nil
+}
+
+// UnmarshalCaddyfile parses the json format. Syntax:
+//
+//	format json
+func (*JSON) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume format name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// requestURL returns the full URL of the request a raw message was created from.
+func requestURL(msg *nats.Msg, r *http.Request) string {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     r.Host,
+		Path:     msg.Header.Get(common.HeaderUrlPath),
+		RawQuery: msg.Header.Get(common.HeaderUrlQuery),
+	}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	return u.String()
+}
+
+var (
+	_ common.MessageFormat  = (*JSON)(nil)
+	_ caddyfile.Unmarshaler = (*JSON)(nil)
+)
@@ -0,0 +1,44 @@
+package format
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/nats-io/nats.go"
+	"github.com/sandstorm/caddy-nats-bridge/common"
+	"net/http"
+)
+
+// Raw transfers the HTTP body as message data and the HTTP headers as message headers. This is the default if no
+// format is configured.
+type Raw struct{}
+
+func (Raw) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.formats.raw",
+		New: func() caddy.Module { return new(Raw) },
+	}
+}
+
+func (Raw) Encode(msg *nats.Msg, _ *http.Request, _ *caddy.Replacer) (*nats.Msg, error) {
+	return msg, nil
+}
+
+func (Raw) Decode(msg *nats.Msg) (*nats.Msg, error) {
+	return msg, nil
+}
+
+// UnmarshalCaddyfile parses the raw format. Syntax:
+//
+//	format raw
+func (*Raw) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume format name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+var (
+	_ common.MessageFormat  = (*Raw)(nil)
+	_ caddyfile.Unmarshaler = (*Raw)(nil)
+)
@@ -23,7 +23,7 @@ func (tn *TestNats) RestartServer(t *testing.T) {
 	t.Logf("Started NATS Server")
 }
 
-func StartTestNats(t *testing.T) TestNats {
+func StartTestNats(t *testing.T) *TestNats {
 	natsServer := runServerOnPort(TEST_PORT)
 
 	serverUrl := fmt.Sprintf("nats://127.0.0.1:%d", TEST_PORT)
@@ -35,7 +35,7 @@ func StartTestNats(t *testing.T) TestNats {
 		natsClient.Drain()
 	})
 
-	tn := TestNats{
+	tn := &TestNats{
 		Server:     natsServer,
 		ClientConn: natsClient,
 	}
@@ -47,6 +47,18 @@ func StartTestNats(t *testing.T) TestNats {
 	return tn
 }
 
+// ResetJetStream deletes all streams - and so all KV buckets and object stores - as the JetStream storage of the test
+// server survives test runs. It returns the JetStream context of the client connection.
+func (tn *TestNats) ResetJetStream(t *testing.T) nats.JetStreamContext {
+	js, err := tn.ClientConn.JetStream()
+	FailOnErr("could not load JetStream: %s", err, t)
+	for name := range js.StreamNames() {
+		err = js.DeleteStream(name)
+		FailOnErr("could not delete stream: %s", err, t)
+	}
+	return js
+}
+
 func runServerOnPort(port int) *server.Server {
 	opts := natsserver.DefaultTestOptions
 	opts.Port = port
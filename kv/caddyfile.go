@@ -0,0 +1,47 @@
+package kv
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// ParseKeyValueHandler parses the nats_kv directive. Syntax:
+//
+//	nats_kv [matcher] [serverAlias] bucket {
+//	    [read_only]
+//	}
+func ParseKeyValueHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var k = KeyValue{}
+	err := k.UnmarshalCaddyfile(h.Dispenser)
+	return k, err
+}
+
+func (k *KeyValue) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.CountRemainingArgs() == 2 {
+			if !d.Args(&k.ServerAlias, &k.Bucket) {
+				// should never fail because of the check above for remainingArgs==2
+				return d.Errf("Wrong argument count or unexpected line ending after '%s'", d.Val())
+			}
+		} else {
+			if !d.Args(&k.Bucket) {
+				return d.Errf("Wrong argument count or unexpected line ending after '%s'", d.Val())
+			}
+		}
+
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "read_only":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				k.ReadOnly = true
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,337 @@
+package kv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/nats-io/nats.go"
+	"github.com/sandstorm/caddy-nats-bridge/natsbridge"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// KeyValue exposes a JetStream Key-Value bucket via HTTP. The key is the request path without leading slash (use
+// handle_path to strip a prefix):
+//
+//   - GET /key returns the value, with the revision as ETag; If-None-Match is answered with 304.
+//   - PUT /key stores the request body. With If-Match: "revision", the value is only stored if the key is still at this
+//     revision (compare-and-swap); with If-None-Match: *, only if the key does not exist yet. Otherwise 412.
+//   - DELETE /key deletes the key; If-Match is supported as for PUT.
+//   - GET / lists the keys as JSON array; filtered by the prefix query parameter.
+//   - GET /key?watch and GET /?watch stream the current values and all updates as server-sent events.
+type KeyValue struct {
+	Bucket      string `json:"bucket,omitempty"`
+	ServerAlias string `json:"serverAlias,omitempty"`
+	// only GET and HEAD requests are allowed.
+	ReadOnly bool `json:"readOnly,omitempty"`
+
+	logger *zap.Logger
+	app    *natsbridge.NatsBridgeApp
+	// do not use directly, but always use keyValue() to access, to ensure it is initialized.
+	store *atomic.Pointer[nats.KeyValue]
+}
+
+// watchEvent is the data of a server-sent event in watch mode.
+type watchEvent struct {
+	Key      string `json:"key"`
+	Revision uint64 `json:"revision"`
+	// base64 encoded; empty for deleted keys.
+	Value []byte `json:"value,omitempty"`
+}
+
+func (KeyValue) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.nats_kv",
+		New: func() caddy.Module {
+			// Default values
+			return &KeyValue{
+				ServerAlias: "default",
+			}
+		},
+	}
+}
+
+func (k *KeyValue) Provision(ctx caddy.Context) error {
+	k.logger = ctx.Logger(k)
+
+	natsAppIface, err := ctx.App("nats")
+	if err != nil {
+		return fmt.Errorf("getting NATS app: %v. Make sure NATS is configured in nats options", err)
+	}
+	k.app = natsAppIface.(*natsbridge.NatsBridgeApp)
+
+	if k.Bucket == "" {
+		return fmt.Errorf("bucket is required")
+	}
+	k.store = &atomic.Pointer[nats.KeyValue]{}
+	return nil
+}
+
+func (k KeyValue) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	_, watch := r.URL.Query()["watch"]
+
+	var allowed bool
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		allowed = true
+	case http.MethodPut, http.MethodDelete:
+		// the bucket itself cannot be written.
+		allowed = !k.ReadOnly && key != ""
+	}
+	if !allowed {
+		if k.ReadOnly {
+			w.Header().Set("Allow", "GET, HEAD")
+		} else {
+			w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		}
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+
+	store, err := k.keyValue()
+	if err != nil {
+		return caddyhttp.Error(http.StatusServiceUnavailable, err)
+	}
+
+	switch {
+	case watch && r.Method == http.MethodGet:
+		return k.watch(w, r, store, key)
+	case key == "":
+		return k.list(w, r, store)
+	case r.Method == http.MethodPut:
+		return k.put(w, r, store, key)
+	case r.Method == http.MethodDelete:
+		return k.delete(w, r, store, key)
+	default:
+		return k.get(w, r, store, key)
+	}
+}
+
+func (k KeyValue) get(w http.ResponseWriter, r *http.Request, store nats.KeyValue, key string) error {
+	entry, err := store.Get(key)
+	if err != nil {
+		return kvError(err)
+	}
+
+	etag := revisionETag(entry.Revision())
+	w.Header().Set("ETag", etag)
+	if matchesETag(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.Value())))
+	_, err = w.Write(entry.Value())
+	return err
+}
+
+func (k KeyValue) put(w http.ResponseWriter, r *http.Request, store nats.KeyValue, key string) error {
+	value, err := io.ReadAll(r.Body)
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("cannot read request body: %w", err))
+	}
+
+	var revision uint64
+	switch {
+	case r.Header.Get("If-Match") != "":
+		var expected uint64
+		expected, err = parseRevisionETag(r.Header.Get("If-Match"))
+		if err != nil {
+			return caddyhttp.Error(http.StatusPreconditionFailed, err)
+		}
+		revision, err = store.Update(key, value, expected)
+	case r.Header.Get("If-None-Match") == "*":
+		revision, err = store.Create(key, value)
+	default:
+		revision, err = store.Put(key, value)
+	}
+	if err != nil {
+		return kvError(err)
+	}
+
+	k.logger.Debug("stored KV value", zap.String("bucket", k.Bucket), zap.String("key", key), zap.Uint64("revision", revision))
+	w.Header().Set("ETag", revisionETag(revision))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (k KeyValue) delete(w http.ResponseWriter, r *http.Request, store nats.KeyValue, key string) error {
+	var opts []nats.DeleteOpt
+	if r.Header.Get("If-Match") != "" {
+		expected, err := parseRevisionETag(r.Header.Get("If-Match"))
+		if err != nil {
+			return caddyhttp.Error(http.StatusPreconditionFailed, err)
+		}
+		opts = append(opts, nats.LastRevision(expected))
+	}
+	err := store.Delete(key, opts...)
+	if err != nil {
+		return kvError(err)
+	}
+
+	k.logger.Debug("deleted KV value", zap.String("bucket", k.Bucket), zap.String("key", key))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (k KeyValue) list(w http.ResponseWriter, r *http.Request, store nats.KeyValue) error {
+	prefix := r.URL.Query().Get("prefix")
+	keys, err := store.Keys()
+	if err != nil && !errors.Is(err, nats.ErrNoKeysFound) {
+		return kvError(err)
+	}
+
+	filtered := []string{}
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			filtered = append(filtered, key)
+		}
+	}
+	sort.Strings(filtered)
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(filtered)
+}
+
+// watch streams the current values and all updates of the key (or of all keys with the prefix query parameter, if
+// key is empty) as server-sent events, until the client disconnects. The event type is put or delete, the event ID is
+// the revision; and the data is a watchEvent. A ready event marks the end of the current values.
+func (k KeyValue) watch(w http.ResponseWriter, r *http.Request, store nats.KeyValue, key string) error {
+	var watcher nats.KeyWatcher
+	var err error
+	if key == "" {
+		watcher, err = store.WatchAll(nats.Context(r.Context()))
+	} else {
+		watcher, err = store.Watch(key, nats.Context(r.Context()))
+	}
+	if err != nil {
+		return kvError(err)
+	}
+	defer watcher.Stop()
+
+	prefix := r.URL.Query().Get("prefix")
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	err = rc.Flush()
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				return nil
+			}
+			if entry == nil {
+				// all current values are delivered.
+				_, err = fmt.Fprint(w, "event: ready\ndata: {}\n\n")
+			} else if strings.HasPrefix(entry.Key(), prefix) {
+				err = writeWatchEvent(w, entry)
+			}
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func writeWatchEvent(w io.Writer, entry nats.KeyValueEntry) error {
+	eventType := "put"
+	event := watchEvent{Key: entry.Key(), Revision: entry.Revision()}
+	if entry.Operation() == nats.KeyValuePut {
+		event.Value = entry.Value()
+	} else {
+		eventType = "delete"
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", eventType, entry.Revision(), data)
+	return err
+}
+
+// keyValue is lazily loading the KV bucket on first access; the bucket is not created, as it should be provisioned
+// explicitly before it is exposed.
+func (k KeyValue) keyValue() (nats.KeyValue, error) {
+	tmp := k.store.Load()
+	if tmp != nil {
+		return *tmp, nil
+	}
+
+	server, ok := k.app.Servers[k.ServerAlias]
+	if !ok {
+		return nil, fmt.Errorf("NATS server alias %s not found", k.ServerAlias)
+	}
+	js, err := server.Conn.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("could not load JetStream: %w", err)
+	}
+	store, err := js.KeyValue(k.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("could not load KV bucket %s: %w", k.Bucket, err)
+	}
+
+	k.store.Store(&store)
+	return store, nil
+}
+
+// kvError maps errors of the KV bucket to HTTP errors.
+func kvError(err error) error {
+	var apiErr *nats.APIError
+	switch {
+	case errors.Is(err, nats.ErrKeyNotFound), errors.Is(err, nats.ErrKeyDeleted):
+		return caddyhttp.Error(http.StatusNotFound, err)
+	case errors.Is(err, nats.ErrInvalidKey):
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	case errors.Is(err, nats.ErrKeyExists),
+		errors.As(err, &apiErr) && apiErr.ErrorCode == nats.JSErrCodeStreamWrongLastSequence:
+		return caddyhttp.Error(http.StatusPreconditionFailed, err)
+	default:
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+}
+
+func revisionETag(revision uint64) string {
+	return `"` + strconv.FormatUint(revision, 10) + `"`
+}
+
+func parseRevisionETag(etag string) (uint64, error) {
+	revision, err := strconv.ParseUint(strings.Trim(strings.TrimSpace(etag), `"`), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("If-Match must be a revision ETag, got: %s", etag)
+	}
+	return revision, nil
+}
+
+// matchesETag returns whether an If-None-Match header matches the ETag.
+func matchesETag(ifNoneMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	_ caddyhttp.MiddlewareHandler = (*KeyValue)(nil)
+	_ caddy.Provisioner           = (*KeyValue)(nil)
+	_ caddyfile.Unmarshaler       = (*KeyValue)(nil)
+)
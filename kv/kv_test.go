@@ -0,0 +1,158 @@
+package kv_test
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	_ "github.com/sandstorm/caddy-nats-bridge"
+	"github.com/sandstorm/caddy-nats-bridge/integrationtest"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupKeyValue(t *testing.T) (*integrationtest.TestNats, nats.KeyValue) {
+	tn := integrationtest.StartTestNats(t)
+	js := tn.ResetJetStream(t)
+	store, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "config"})
+	integrationtest.FailOnErr("could not create KV bucket: %s", err, t)
+
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			handle_path /kv/* {
+				route {
+					nats_kv config
+				}
+			}
+			handle_path /readonly/* {
+				route {
+					nats_kv config {
+						read_only
+					}
+				}
+			}
+		}
+	`, ""), "caddyfile")
+	return tn, store
+}
+
+func doRequest(t *testing.T, method string, path string, body string, header map[string]string) (*http.Response, string) {
+	req, err := http.NewRequest(method, "http://localhost:8889"+path, strings.NewReader(body))
+	integrationtest.FailOnErr("could not create request: %s", err, t)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	integrationtest.FailOnErr("could not read response body: %s", err, t)
+	return res, string(b)
+}
+
+// TestKeyValueRest checks GET, PUT and DELETE of single keys incl. compare-and-swap, and the key listing.
+func TestKeyValueRest(t *testing.T) {
+	_, store := setupKeyValue(t)
+
+	type step struct {
+		description    string
+		method         string
+		path           string
+		body           string
+		header         map[string]string
+		expectedStatus int
+		expectedBody   string
+		expectedETag   string
+	}
+	steps := []step{
+		{description: "missing key", method: "GET", path: "/kv/app.color", expectedStatus: 404},
+		{description: "create", method: "PUT", path: "/kv/app.color", body: "red", header: map[string]string{"If-None-Match": "*"}, expectedStatus: 204, expectedETag: `"1"`},
+		{description: "create existing", method: "PUT", path: "/kv/app.color", body: "red", header: map[string]string{"If-None-Match": "*"}, expectedStatus: 412},
+		{description: "get", method: "GET", path: "/kv/app.color", expectedStatus: 200, expectedBody: "red", expectedETag: `"1"`},
+		{description: "not modified", method: "GET", path: "/kv/app.color", header: map[string]string{"If-None-Match": `"1"`}, expectedStatus: 304, expectedETag: `"1"`},
+		{description: "update", method: "PUT", path: "/kv/app.color", body: "blue", header: map[string]string{"If-Match": `"1"`}, expectedStatus: 204, expectedETag: `"2"`},
+		{description: "update conflict", method: "PUT", path: "/kv/app.color", body: "green", header: map[string]string{"If-Match": `"1"`}, expectedStatus: 412},
+		{description: "put", method: "PUT", path: "/kv/app.size", body: "XL", expectedStatus: 204, expectedETag: `"3"`},
+		{description: "put other prefix", method: "PUT", path: "/kv/other.key", body: "x", expectedStatus: 204, expectedETag: `"4"`},
+		{description: "list", method: "GET", path: "/kv/", expectedStatus: 200, expectedBody: `["app.color","app.size","other.key"]` + "\n"},
+		{description: "list with prefix", method: "GET", path: "/kv/?prefix=app.", expectedStatus: 200, expectedBody: `["app.color","app.size"]` + "\n"},
+		{description: "delete conflict", method: "DELETE", path: "/kv/app.color", header: map[string]string{"If-Match": `"1"`}, expectedStatus: 412},
+		{description: "delete", method: "DELETE", path: "/kv/app.color", header: map[string]string{"If-Match": `"2"`}, expectedStatus: 204},
+		{description: "deleted key", method: "GET", path: "/kv/app.color", expectedStatus: 404},
+		{description: "put with watch parameter", method: "PUT", path: "/kv/app.watched?watch", body: "yes", expectedStatus: 204, expectedETag: `"6"`},
+		{description: "unlisted method", method: "PATCH", path: "/kv/app.size", expectedStatus: 405},
+		{description: "part of a listed method", method: "GE", path: "/kv/app.size", expectedStatus: 405},
+		{description: "invalid key", method: "GET", path: "/kv/in valid", expectedStatus: 400},
+		{description: "read only get", method: "GET", path: "/readonly/app.size", expectedStatus: 200, expectedBody: "XL", expectedETag: `"3"`},
+		{description: "read only put", method: "PUT", path: "/readonly/app.size", body: "S", expectedStatus: 405},
+	}
+	for _, s := range steps {
+		res, body := doRequest(t, s.method, s.path, s.body, s.header)
+		if res.StatusCode != s.expectedStatus || (s.expectedBody != "" && body != s.expectedBody) || res.Header.Get("ETag") != s.expectedETag {
+			t.Fatalf("%s: wrong response. Expected: %d %q ETag %q. Actual: %d %q ETag %q", s.description, s.expectedStatus, s.expectedBody, s.expectedETag, res.StatusCode, body, res.Header.Get("ETag"))
+		}
+	}
+
+	entry, err := store.Get("app.size")
+	integrationtest.FailOnErr("could not read key: %s", err, t)
+	if string(entry.Value()) != "XL" {
+		t.Fatalf("value not stored in KV bucket: %s", entry.Value())
+	}
+}
+
+// TestKeyValueWatch checks that the watch mode streams the current values and updates as server-sent events.
+func TestKeyValueWatch(t *testing.T) {
+	_, store := setupKeyValue(t)
+	_, err := store.Put("app.color", []byte("red"))
+	integrationtest.FailOnErr("could not put key: %s", err, t)
+	_, err = store.Put("other.key", []byte("x"))
+	integrationtest.FailOnErr("could not put key: %s", err, t)
+
+	res, err := http.Get("http://localhost:8889/kv/?watch&prefix=app.")
+	integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("wrong Content-Type: %s", res.Header.Get("Content-Type"))
+	}
+
+	events := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		var event []string
+		for scanner.Scan() {
+			if scanner.Text() != "" {
+				event = append(event, scanner.Text())
+				continue
+			}
+			events <- strings.Join(event, "|")
+			event = nil
+		}
+		close(events)
+	}()
+	assertEvent := func(expected string) {
+		select {
+		case actual := <-events:
+			if actual != expected {
+				t.Fatalf("wrong event. Expected: %s. Actual: %s", expected, actual)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no event received, expected: %s", expected)
+		}
+	}
+
+	assertEvent(`event: put|id: 1|data: {"key":"app.color","revision":1,"value":"cmVk"}`)
+	assertEvent(`event: ready|data: {}`)
+
+	_, err = store.Put("other.key", []byte("y"))
+	integrationtest.FailOnErr("could not put key: %s", err, t)
+	_, err = store.Put("app.color", []byte("blue"))
+	integrationtest.FailOnErr("could not put key: %s", err, t)
+	assertEvent(`event: put|id: 4|data: {"key":"app.color","revision":4,"value":"Ymx1ZQ=="}`)
+
+	err = store.Delete("app.color")
+	integrationtest.FailOnErr("could not delete key: %s", err, t)
+	assertEvent(`event: delete|id: 5|data: {"key":"app.color","revision":5}`)
+}
@@ -2,6 +2,7 @@ package logoutput
 
 import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/sandstorm/caddy-nats-bridge/common"
 )
 
 func (p *LogOutput) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
@@ -19,6 +20,12 @@ func (p *LogOutput) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 		for d.NextBlock(0) {
 			switch d.Val() {
+			case "compress":
+				compress, err := common.ParseCompression(d)
+				if err != nil {
+					return err
+				}
+				p.Compress = compress
 			/*case "timeout":
 			if !d.NextArg() {
 				return d.ArgErr()
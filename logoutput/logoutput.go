@@ -5,6 +5,7 @@ import (
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/nats-io/nats.go"
+	"github.com/sandstorm/caddy-nats-bridge/common"
 	"github.com/sandstorm/caddy-nats-bridge/natsbridge"
 	"go.uber.org/zap"
 	"io"
@@ -13,6 +14,8 @@ import (
 type LogOutput struct {
 	Subject     string `json:"subject,omitempty"`
 	ServerAlias string `json:"serverAlias,omitempty"`
+	// compresses the log messages; not compressed if not set.
+	Compress *common.Compression `json:"compress,omitempty"`
 
 	logger   *zap.Logger
 	caddyCtx caddy.Context
@@ -34,15 +37,21 @@ func (p *LogOutput) Provision(ctx caddy.Context) error {
 	p.logger = ctx.Logger(p)
 	p.caddyCtx = ctx
 
-	return nil
+	return p.Compress.Validate()
 }
 
 func (p LogOutput) String() string {
 	return fmt.Sprintf("nats(server=%s, subject=%s)", p.ServerAlias, p.Subject)
 }
 
+// WriterKey identifies the writer in Caddy's writer pool; so it must contain all settings of the writer. Otherwise, a
+// reload which only changes the compression would keep the old writer.
 func (p LogOutput) WriterKey() string {
-	return fmt.Sprintf("nats-%s%s", p.ServerAlias, p.Subject)
+	key := fmt.Sprintf("nats-%s%s", p.ServerAlias, p.Subject)
+	if p.Compress != nil {
+		key += fmt.Sprintf("-compress-%s-%d", p.Compress.Algorithm, p.Compress.MinSize)
+	}
+	return key
 }
 
 func (p LogOutput) OpenWriter() (io.WriteCloser, error) {
@@ -65,25 +74,41 @@ func (lw LogOutputWriter) Write(msg []byte) (n int, err error) {
 	//
 	// => WORKAROUND: we fetch the natsConnection here, when sending the 1st log message.
 	if lw.natsConn == nil {
-		natsAppIface, err := lw.logOutput.caddyCtx.App("nats")
+		lw.natsConn, err = lw.logOutput.natsConn()
 		if err != nil {
-			return 0, fmt.Errorf("getting NATS app: %w. Make sure NATS is configured in nats options", err)
-		}
-		app := natsAppIface.(*natsbridge.NatsBridgeApp)
-		server, ok := app.Servers[lw.logOutput.ServerAlias]
-		if !ok {
-			return 0, fmt.Errorf("NATS server alias %s not found", lw.logOutput.ServerAlias)
+			return 0, err
 		}
-		lw.natsConn = server.Conn
 	}
 
-	err = lw.natsConn.Publish(lw.logOutput.Subject, msg)
+	natsMsg := &nats.Msg{
+		Subject: lw.logOutput.Subject,
+		Data:    msg,
+	}
+	err = lw.logOutput.Compress.Compress(natsMsg)
+	if err != nil {
+		return 0, fmt.Errorf("error compressing log message: %w", err)
+	}
+	err = lw.natsConn.PublishMsg(natsMsg)
 	if err != nil {
 		return 0, fmt.Errorf("error writing log message: %w", err)
 	}
 	return len(msg), nil
 }
 
+// natsConn returns the connection of the configured NATS server.
+//
+// Caddy keeps log writers open across config reloads (they are pooled by WriterKey), while the NATS app
+// this LogOutput was provisioned with is stopped on reload - which closes its connections. In this case,
+// we use the NATS app of the currently active config instead.
+func (p LogOutput) natsConn() (*nats.Conn, error) {
+	conn, err := natsbridge.ServerConn(p.caddyCtx, p.ServerAlias)
+	if err == nil && !conn.IsClosed() && !conn.IsDraining() {
+		return conn, nil
+	}
+
+	return natsbridge.ServerConn(caddy.ActiveContext(), p.ServerAlias)
+}
+
 func (lw LogOutputWriter) Close() error {
 	// nothing to be done
 	return nil
@@ -11,7 +11,9 @@ import (
 import (
 	"fmt"
 	_ "github.com/sandstorm/caddy-nats-bridge"
+	"github.com/sandstorm/caddy-nats-bridge/common"
 	"github.com/sandstorm/caddy-nats-bridge/integrationtest"
+	"github.com/sandstorm/caddy-nats-bridge/logoutput"
 	"net/http"
 	"testing"
 	"time"
@@ -225,7 +227,7 @@ func TestLogRequestToNats(t *testing.T) {
 			// HTTP Request and assertion Goroutine
 			httpResultChan := make(chan error)
 			go func() {
-				httpResultChan <- testcase.sendHttpRequestAndAssertResponse(t, &testNats)
+				httpResultChan <- testcase.sendHttpRequestAndAssertResponse(t, testNats)
 			}()
 
 			// handle NATS message and generate response.
@@ -280,3 +282,18 @@ func forceReloadCaddy(t *testing.T) {
 	}
 	return
 }
+
+func TestWriterKeyContainsCompression(t *testing.T) {
+	plain := logoutput.LogOutput{ServerAlias: "default", Subject: "logs"}
+	gzip := logoutput.LogOutput{ServerAlias: "default", Subject: "logs", Compress: &common.Compression{Algorithm: common.CompressionGzip}}
+	gzipMinSize := logoutput.LogOutput{ServerAlias: "default", Subject: "logs", Compress: &common.Compression{Algorithm: common.CompressionGzip, MinSize: 1024}}
+	zstd := logoutput.LogOutput{ServerAlias: "default", Subject: "logs", Compress: &common.Compression{Algorithm: common.CompressionZstd}}
+
+	keys := map[string]bool{}
+	for _, l := range []logoutput.LogOutput{plain, gzip, gzipMinSize, zstd} {
+		keys[l.WriterKey()] = true
+	}
+	if len(keys) != 4 {
+		t.Fatalf("writers with different compression settings must have different keys, got: %v", keys)
+	}
+}
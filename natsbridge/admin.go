@@ -0,0 +1,254 @@
+package natsbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/sandstorm/caddy-nats-bridge/common"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const adminNatsEndpointBase = "/nats/"
+
+// AdminAPI exposes introspection endpoints for the NATS bridge on the Caddy admin API:
+//
+//	GET  /nats/servers                            connection status and subscriptions of all servers
+//	GET  /nats/servers/{alias}                    same, for a single server
+//	POST /nats/servers/{alias}/publish?subject=x  publish the request body to subject x (debugging aid)
+type AdminAPI struct {
+	logger *zap.Logger
+	app    *NatsBridgeApp
+}
+
+// CaddyModule returns the Caddy module information.
+func (AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.nats",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+func (a *AdminAPI) Provision(ctx caddy.Context) error {
+	a.logger = ctx.Logger(a)
+
+	// admin routers are provisioned after all apps; we do not want to instantiate the NATS app if
+	// it is not configured, so we ignore the error here (and answer with 404 in this case).
+	natsAppIface, err := ctx.AppIfConfigured("nats")
+	if err == nil {
+		a.app = natsAppIface.(*NatsBridgeApp)
+	}
+	return nil
+}
+
+// Routes returns the admin routes for the NATS app.
+func (a *AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: adminNatsEndpointBase,
+			Handler: caddy.AdminHandlerFunc(a.handleAPIEndpoints),
+		},
+	}
+}
+
+// ServerStatus is the JSON representation of a NATS server returned by the admin API.
+type ServerStatus struct {
+	Url           string               `json:"url,omitempty"`
+	Status        string               `json:"status"`
+	Connected     bool                 `json:"connected"`
+	ConnectedUrl  string               `json:"connectedUrl,omitempty"`
+	RTT           string               `json:"rtt,omitempty"`
+	Stats         nats.Statistics      `json:"stats"`
+	Subscriptions []SubscriptionStatus `json:"subscriptions"`
+}
+
+// SubscriptionStatus is the JSON representation of a NATS subscription returned by the admin API.
+type SubscriptionStatus struct {
+	Subject      string `json:"subject"`
+	QueueGroup   string `json:"queueGroup,omitempty"`
+	Valid        bool   `json:"valid"`
+	PendingMsgs  int    `json:"pendingMsgs"`
+	PendingBytes int    `json:"pendingBytes"`
+	Delivered    int64  `json:"delivered"`
+	Dropped      int    `json:"dropped"`
+}
+
+func (a *AdminAPI) handleAPIEndpoints(w http.ResponseWriter, r *http.Request) error {
+	uri := strings.TrimPrefix(r.URL.Path, adminNatsEndpointBase)
+	parts := strings.Split(strings.TrimSuffix(uri, "/"), "/")
+
+	app := a.app
+	if app == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("NATS app is not configured"),
+		}
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "servers":
+		return a.handleServers(w, r, app)
+	case len(parts) == 2 && parts[0] == "servers":
+		return a.handleServer(w, r, app, parts[1])
+	case len(parts) == 3 && parts[0] == "servers" && parts[2] == "publish":
+		return a.handlePublish(w, r, app, parts[1])
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("resource not found: %v", r.URL.Path),
+		}
+	}
+}
+
+func (a *AdminAPI) handleServers(w http.ResponseWriter, r *http.Request, app *NatsBridgeApp) error {
+	if r.Method != http.MethodGet {
+		return methodNotAllowed(r)
+	}
+
+	result := make(map[string]ServerStatus, len(app.Servers))
+	for alias, server := range app.Servers {
+		result[alias] = serverStatus(server)
+	}
+	return writeJSON(w, result)
+}
+
+func (a *AdminAPI) handleServer(w http.ResponseWriter, r *http.Request, app *NatsBridgeApp, alias string) error {
+	if r.Method != http.MethodGet {
+		return methodNotAllowed(r)
+	}
+
+	server, err := serverByAlias(app, alias)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, serverStatus(server))
+}
+
+func (a *AdminAPI) handlePublish(w http.ResponseWriter, r *http.Request, app *NatsBridgeApp, alias string) error {
+	if r.Method != http.MethodPost {
+		return methodNotAllowed(r)
+	}
+
+	server, err := serverByAlias(app, alias)
+	if err != nil {
+		return err
+	}
+	subject := r.URL.Query().Get("subject")
+	if subject == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("query parameter 'subject' is required"),
+		}
+	}
+	if server.Conn == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusServiceUnavailable,
+			Err:        fmt.Errorf("NATS server alias %s is not connected", alias),
+		}
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("cannot read request body: %w", err),
+		}
+	}
+
+	a.logger.Info("publishing NATS message via admin API", zap.String("server", alias), zap.String("subject", subject))
+	err = server.Conn.Publish(subject, data)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadGateway,
+			Err:        fmt.Errorf("could not publish NATS message: %w", err),
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func serverByAlias(app *NatsBridgeApp, alias string) (*NatsServer, error) {
+	server, ok := app.Servers[alias]
+	if !ok {
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("NATS server alias %s not found", alias),
+		}
+	}
+	return server, nil
+}
+
+func serverStatus(server *NatsServer) ServerStatus {
+	st := ServerStatus{
+		Url:           server.NatsUrl,
+		Status:        nats.DISCONNECTED.String(),
+		Subscriptions: []SubscriptionStatus{},
+	}
+	for _, handler := range server.Handlers {
+		if h, ok := handler.(common.NatsHandlerWithSubscription); ok {
+			st.Subscriptions = append(st.Subscriptions, subscriptionStatus(h))
+		}
+	}
+
+	conn := server.Conn
+	if conn == nil {
+		return st
+	}
+	st.Status = conn.Status().String()
+	st.Connected = conn.IsConnected()
+	st.ConnectedUrl = conn.ConnectedUrlRedacted()
+	st.Stats = conn.Stats()
+	if st.Connected {
+		if rtt, err := conn.RTT(); err == nil {
+			st.RTT = rtt.Round(time.Microsecond).String()
+		}
+	}
+	return st
+}
+
+func subscriptionStatus(h common.NatsHandlerWithSubscription) SubscriptionStatus {
+	sub := h.Subscription()
+	if sub == nil {
+		return SubscriptionStatus{}
+	}
+	st := SubscriptionStatus{
+		Subject:    sub.Subject,
+		QueueGroup: sub.Queue,
+		Valid:      sub.IsValid(),
+	}
+	// these calls fail for closed subscriptions; we then simply report zero values.
+	st.PendingMsgs, st.PendingBytes, _ = sub.Pending()
+	st.Delivered, _ = sub.Delivered()
+	st.Dropped, _ = sub.Dropped()
+	return st
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("failed to encode JSON: %w", err),
+		}
+	}
+	return nil
+}
+
+func methodNotAllowed(r *http.Request) error {
+	return caddy.APIError{
+		HTTPStatus: http.StatusMethodNotAllowed,
+		Err:        fmt.Errorf("method not allowed: %v", r.Method),
+	}
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*AdminAPI)(nil)
+	_ caddy.Provisioner = (*AdminAPI)(nil)
+)
@@ -0,0 +1,81 @@
+package natsbridge_test
+
+import (
+	"encoding/json"
+	"fmt"
+	_ "github.com/sandstorm/caddy-nats-bridge"
+	"github.com/sandstorm/caddy-nats-bridge/integrationtest"
+	"github.com/sandstorm/caddy-nats-bridge/natsbridge"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAdminAPI checks the NATS endpoints registered on the Caddy admin API.
+func TestAdminAPI(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			respond 200
+		}
+	`, `subscribe foo.> POST http://localhost:8889/test {
+			queue q
+		}`), "caddyfile")
+
+	t.Run("GET /nats/servers lists connection status and subscriptions", func(t *testing.T) {
+		res, err := http.Get("http://127.0.0.1:2999/nats/servers")
+		integrationtest.FailOnErr("admin API request failed: %s", err, t)
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("wrong status code. Expected: 200. Actual: %d", res.StatusCode)
+		}
+
+		var servers map[string]natsbridge.ServerStatus
+		err = json.NewDecoder(res.Body).Decode(&servers)
+		integrationtest.FailOnErr("could not decode response: %s", err, t)
+
+		server, ok := servers["default"]
+		if !ok {
+			t.Fatalf("server 'default' not found in response: %+v", servers)
+		}
+		if !server.Connected || server.Status != "CONNECTED" {
+			t.Fatalf("server should be connected. Actual: %+v", server)
+		}
+		if server.RTT == "" {
+			t.Fatalf("RTT should be set. Actual: %+v", server)
+		}
+		if len(server.Subscriptions) != 1 || server.Subscriptions[0].Subject != "foo.>" || server.Subscriptions[0].QueueGroup != "q" {
+			t.Fatalf("subscription not correct. Actual: %+v", server.Subscriptions)
+		}
+	})
+
+	t.Run("GET /nats/servers/{alias} for unknown alias returns 404", func(t *testing.T) {
+		res, err := http.Get("http://127.0.0.1:2999/nats/servers/unknown")
+		integrationtest.FailOnErr("admin API request failed: %s", err, t)
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("wrong status code. Expected: 404. Actual: %d", res.StatusCode)
+		}
+	})
+
+	t.Run("POST /nats/servers/{alias}/publish publishes the body", func(t *testing.T) {
+		subscription, err := tn.ClientConn.SubscribeSync("debug.>")
+		integrationtest.FailOnErr("error subscribing to debug.>: %s", err, t)
+		defer subscription.Unsubscribe()
+
+		res, err := http.Post("http://127.0.0.1:2999/nats/servers/default/publish?subject=debug.hello", "text/plain", strings.NewReader("hello"))
+		integrationtest.FailOnErr("admin API request failed: %s", err, t)
+		res.Body.Close()
+		if res.StatusCode != http.StatusNoContent {
+			t.Fatalf("wrong status code. Expected: 204. Actual: %d", res.StatusCode)
+		}
+
+		msg, err := subscription.NextMsg(100 * time.Millisecond)
+		integrationtest.FailOnErr("message not received: %s", err, t)
+		if string(msg.Data) != "hello" {
+			t.Fatalf("wrong message payload. Expected: hello. Actual: %s", string(msg.Data))
+		}
+	})
+}
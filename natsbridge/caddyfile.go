@@ -2,10 +2,12 @@ package natsbridge
 
 import (
 	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/sandstorm/caddy-nats-bridge/subscribe"
+	"strconv"
 )
 
 func ParseGobalNatsOption(d *caddyfile.Dispenser, existingVal interface{}) (interface{}, error) {
@@ -70,6 +72,21 @@ func (app *NatsBridgeApp) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if !d.AllArgs(&server.InboxPrefix) {
 					return d.ArgErr()
 				}
+			case "shutdownGracePeriod":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Err("shutdownGracePeriod is not a valid duration")
+				}
+				server.ShutdownGracePeriod = t
+			case "embedded":
+				embedded, err := parseEmbeddedServer(d)
+				if err != nil {
+					return err
+				}
+				server.Embedded = embedded
 			case "subscribe":
 				s, err := subscribe.ParseSubscribeHandler(d)
 				if err != nil {
@@ -85,3 +102,103 @@ func (app *NatsBridgeApp) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 	return nil
 }
+
+func parseEmbeddedServer(d *caddyfile.Dispenser) (*EmbeddedServer, error) {
+	embedded := &EmbeddedServer{}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "serverName":
+			if !d.AllArgs(&embedded.ServerName) {
+				return nil, d.ArgErr()
+			}
+		case "host":
+			if !d.AllArgs(&embedded.Host) {
+				return nil, d.ArgErr()
+			}
+		case "port":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			port, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("port is not a valid number: %s", d.Val())
+			}
+			embedded.Port = port
+		case "configFile":
+			if !d.AllArgs(&embedded.ConfigFile) {
+				return nil, d.ArgErr()
+			}
+		case "jetStream":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			embedded.JetStream = true
+		case "jetStreamDir":
+			if !d.AllArgs(&embedded.JetStreamDir) {
+				return nil, d.ArgErr()
+			}
+		case "noAuthUser":
+			if !d.AllArgs(&embedded.NoAuthUser) {
+				return nil, d.ArgErr()
+			}
+		case "leafNodeRemote":
+			remote := &EmbeddedLeafNodeRemote{}
+			if !d.AllArgs(&remote.Url) {
+				return nil, d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "credentials":
+					if !d.AllArgs(&remote.Credentials) {
+						return nil, d.ArgErr()
+					}
+				case "account":
+					if !d.AllArgs(&remote.Account) {
+						return nil, d.ArgErr()
+					}
+				default:
+					return nil, d.Errf("unrecognized leafNodeRemote subdirective: %s", d.Val())
+				}
+			}
+			embedded.LeafNodeRemotes = append(embedded.LeafNodeRemotes, remote)
+		case "account":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			name := d.Val()
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			account := &EmbeddedAccount{}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "user":
+					user := &EmbeddedUser{}
+					if !d.AllArgs(&user.User, &user.Password) {
+						return nil, d.ArgErr()
+					}
+					account.Users = append(account.Users, user)
+				case "jetStream":
+					if d.NextArg() {
+						return nil, d.ArgErr()
+					}
+					account.JetStream = true
+				default:
+					return nil, d.Errf("unrecognized account subdirective: %s", d.Val())
+				}
+			}
+			if embedded.Accounts == nil {
+				embedded.Accounts = make(map[string]*EmbeddedAccount)
+			}
+			embedded.Accounts[name] = account
+		default:
+			return nil, d.Errf("unrecognized embedded subdirective: %s", d.Val())
+		}
+	}
+
+	return embedded, nil
+}
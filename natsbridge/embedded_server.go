@@ -0,0 +1,230 @@
+package natsbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/nats-io/nats-server/v2/server"
+	"go.uber.org/zap"
+	"net/url"
+	"time"
+)
+
+// EmbeddedServer runs a nats-server inside the Caddy process; the server alias it is configured for connects to it.
+// This is useful for single-node or edge deployments, f.e. with a leaf node connection to a central NATS cluster.
+type EmbeddedServer struct {
+	ServerName string `json:"serverName,omitempty"`
+	// defaults to 127.0.0.1
+	Host string `json:"host,omitempty"`
+	// defaults to 4222
+	Port int `json:"port,omitempty"`
+	// optional nats-server config file; all other options override the values from the config file.
+	ConfigFile string `json:"configFile,omitempty"`
+	JetStream  bool   `json:"jetStream,omitempty"`
+	// setting a JetStream directory implies enabling JetStream.
+	JetStreamDir    string                      `json:"jetStreamDir,omitempty"`
+	LeafNodeRemotes []*EmbeddedLeafNodeRemote   `json:"leafNodeRemotes,omitempty"`
+	Accounts        map[string]*EmbeddedAccount `json:"accounts,omitempty"`
+	// clients connecting without credentials (including the Caddy NATS connection) are bound to this user.
+	NoAuthUser string `json:"noAuthUser,omitempty"`
+}
+
+type EmbeddedLeafNodeRemote struct {
+	Url         string `json:"url,omitempty"`
+	Credentials string `json:"credentials,omitempty"`
+	// the local account to bind the leaf node connection to.
+	Account string `json:"account,omitempty"`
+}
+
+type EmbeddedAccount struct {
+	Users     []*EmbeddedUser `json:"users,omitempty"`
+	JetStream bool            `json:"jetStream,omitempty"`
+}
+
+type EmbeddedUser struct {
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// embeddedServers keeps the embedded servers running across config reloads. On a reload, the new NatsBridgeApp
+// is started before the old one is stopped - so without the pool, the new server could not bind to its port.
+var embeddedServers = caddy.NewUsagePool()
+
+type runningEmbeddedServer struct {
+	ns *server.Server
+	// the JSON config the server was last configured with; to detect config changes on reload.
+	configJSON string
+}
+
+func (r *runningEmbeddedServer) Destruct() error {
+	r.ns.Shutdown()
+	r.ns.WaitForShutdown()
+	return nil
+}
+
+func embeddedServerPoolKey(alias string) string {
+	return "nats-embedded-server-" + alias
+}
+
+// startEmbeddedServer starts the embedded server for the given alias; or re-uses an already running one from a
+// previous config (applying config changes via a nats-server config reload).
+//
+// Every call must be paired with a call to stopEmbeddedServer.
+func startEmbeddedServer(alias string, cfg *EmbeddedServer, logger *zap.Logger) (*server.Server, error) {
+	configJSON, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := cfg.serverOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	val, loaded, err := embeddedServers.LoadOrNew(embeddedServerPoolKey(alias), func() (caddy.Destructor, error) {
+		logger.Info("starting embedded NATS server", zap.String("server", alias), zap.String("host", opts.Host), zap.Int("port", opts.Port))
+		ns, err := server.NewServer(opts)
+		if err != nil {
+			return nil, fmt.Errorf("could not create embedded NATS server: %w", err)
+		}
+		ns.SetLoggerV2(natsServerLogger{logger.Sugar().With(zap.String("server", alias))}, false, false, false)
+		go ns.Start()
+		if !ns.ReadyForConnections(10 * time.Second) {
+			ns.Shutdown()
+			return nil, fmt.Errorf("embedded NATS server not ready for connections")
+		}
+		err = cfg.enableAccountJetStream(ns)
+		if err != nil {
+			ns.Shutdown()
+			return nil, err
+		}
+		return &runningEmbeddedServer{ns: ns, configJSON: string(configJSON)}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	running := val.(*runningEmbeddedServer)
+	if loaded && running.configJSON != string(configJSON) {
+		logger.Info("reloading embedded NATS server config", zap.String("server", alias))
+		err = running.ns.ReloadOptions(opts)
+		if err == nil {
+			err = cfg.enableAccountJetStream(running.ns)
+		}
+		if err != nil {
+			_, _ = embeddedServers.Delete(embeddedServerPoolKey(alias))
+			return nil, fmt.Errorf("could not reload embedded NATS server (some options, like the port, require a restart of Caddy): %w", err)
+		}
+		running.configJSON = string(configJSON)
+	}
+
+	return running.ns, nil
+}
+
+// stopEmbeddedServer releases the embedded server of the given alias; it is shut down once it is not used by
+// any config anymore.
+func stopEmbeddedServer(alias string) error {
+	_, err := embeddedServers.Delete(embeddedServerPoolKey(alias))
+	return err
+}
+
+func (cfg *EmbeddedServer) serverOptions() (*server.Options, error) {
+	opts := &server.Options{}
+	if cfg.ConfigFile != "" {
+		var err error
+		opts, err = server.ProcessConfigFile(cfg.ConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load embedded NATS server config file %s: %w", cfg.ConfigFile, err)
+		}
+	}
+
+	if cfg.ServerName != "" {
+		opts.ServerName = cfg.ServerName
+	}
+	if cfg.Host != "" {
+		opts.Host = cfg.Host
+	} else if opts.Host == "" {
+		opts.Host = "127.0.0.1"
+	}
+	if cfg.Port != 0 {
+		opts.Port = cfg.Port
+	} else if opts.Port == 0 {
+		opts.Port = server.DEFAULT_PORT
+	}
+	if cfg.JetStream || cfg.JetStreamDir != "" {
+		opts.JetStream = true
+	}
+	if cfg.JetStreamDir != "" {
+		opts.StoreDir = cfg.JetStreamDir
+	}
+	if cfg.NoAuthUser != "" {
+		opts.NoAuthUser = cfg.NoAuthUser
+	}
+
+	for name, account := range cfg.Accounts {
+		acc := server.NewAccount(name)
+		opts.Accounts = append(opts.Accounts, acc)
+		for _, user := range account.Users {
+			opts.Users = append(opts.Users, &server.User{
+				Username: user.User,
+				Password: user.Password,
+				Account:  acc,
+			})
+		}
+	}
+
+	for _, remote := range cfg.LeafNodeRemotes {
+		u, err := url.Parse(remote.Url)
+		if err != nil {
+			return nil, fmt.Errorf("invalid leaf node remote URL %s: %w", remote.Url, err)
+		}
+		opts.LeafNode.Remotes = append(opts.LeafNode.Remotes, &server.RemoteLeafOpts{
+			URLs:         []*url.URL{u},
+			Credentials:  remote.Credentials,
+			LocalAccount: remote.Account,
+		})
+	}
+
+	return opts, nil
+}
+
+// enableAccountJetStream enables JetStream for the configured accounts. This is not possible via server.Options
+// (only via config files), so we need to do it after the server has started.
+func (cfg *EmbeddedServer) enableAccountJetStream(ns *server.Server) error {
+	for name, account := range cfg.Accounts {
+		if !account.JetStream {
+			continue
+		}
+		acc, err := ns.LookupAccount(name)
+		if err != nil {
+			return fmt.Errorf("embedded NATS server: account %s not found: %w", name, err)
+		}
+		if acc.JetStreamEnabled() {
+			continue
+		}
+		err = acc.EnableJetStream(nil)
+		if err != nil {
+			return fmt.Errorf("embedded NATS server: could not enable JetStream for account %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// natsServerLogger routes the logs of the embedded nats-server to the Caddy logger.
+type natsServerLogger struct {
+	logger *zap.SugaredLogger
+}
+
+func (l natsServerLogger) Noticef(format string, v ...interface{}) { l.logger.Infof(format, v...) }
+func (l natsServerLogger) Warnf(format string, v ...interface{})   { l.logger.Warnf(format, v...) }
+
+// Fatalf must not exit the process (as nats-server does by default), because this would kill Caddy.
+func (l natsServerLogger) Fatalf(format string, v ...interface{}) { l.logger.Errorf(format, v...) }
+func (l natsServerLogger) Errorf(format string, v ...interface{}) { l.logger.Errorf(format, v...) }
+func (l natsServerLogger) Debugf(format string, v ...interface{}) { l.logger.Debugf(format, v...) }
+func (l natsServerLogger) Tracef(format string, v ...interface{}) { l.logger.Debugf(format, v...) }
+
+// Interface guards
+var (
+	_ server.Logger    = natsServerLogger{}
+	_ caddy.Destructor = (*runningEmbeddedServer)(nil)
+)
@@ -0,0 +1,114 @@
+package natsbridge_test
+
+import (
+	"fmt"
+	"github.com/nats-io/nats.go"
+	_ "github.com/sandstorm/caddy-nats-bridge"
+	"github.com/sandstorm/caddy-nats-bridge/integrationtest"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const embeddedServerCaddyConf = `
+{
+	default_bind 127.0.0.1
+	http_port 8889
+	admin 127.0.0.1:2999
+	nats {
+		embedded {
+			port 8370
+			jetStream
+		}
+		subscribe greet POST http://localhost:8889/greet
+	}
+}
+:8889 {
+	respond /greet "%s"
+}
+`
+
+// TestEmbeddedServer runs the NATS server inside Caddy, and checks that it survives config reloads.
+//
+//	┌──────────────┐        ┌───────────────────────┐
+//	│ test client  │ ─────▶ │ Caddy                 │
+//	│ (port 8370)  │ ◀───── │ embedded NATS server  │
+//	└──────────────┘        │  └▶ subscribe greet   │
+//	                        └───────────────────────┘
+func TestEmbeddedServer(t *testing.T) {
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(embeddedServerCaddyConf, "hello"), "caddyfile")
+
+	nc, err := nats.Connect("nats://127.0.0.1:8370")
+	integrationtest.FailOnErr("could not connect to embedded NATS server: %s", err, t)
+	defer nc.Close()
+
+	msg, err := nc.Request("greet", nil, 1*time.Second)
+	integrationtest.FailOnErr("request to embedded NATS server failed: %s", err, t)
+	if string(msg.Data) != "hello" {
+		t.Fatalf("wrong response. Expected: hello. Actual: %s", string(msg.Data))
+	}
+
+	// the reloaded config must re-use the running server (no port conflict, no reconnect of clients)
+	caddyTester.InitServer(fmt.Sprintf(embeddedServerCaddyConf, "hello again"), "caddyfile")
+
+	msg, err = nc.Request("greet", nil, 1*time.Second)
+	integrationtest.FailOnErr("request after reload failed: %s", err, t)
+	if string(msg.Data) != "hello again" {
+		t.Fatalf("wrong response after reload. Expected: hello again. Actual: %s", string(msg.Data))
+	}
+	if reconnects := nc.Stats().Reconnects; reconnects != 0 {
+		t.Fatalf("test client should not have reconnected. Reconnects: %d", reconnects)
+	}
+}
+
+const embeddedServerFailingCaddyConf = `
+{
+	default_bind 127.0.0.1
+	http_port 8889
+	admin 127.0.0.1:2999
+	nats {
+		embedded {
+			port 8371
+		}
+		subscribe "invalid subject" POST http://localhost:8889/greet
+	}
+}
+:8889 {
+	respond /greet "hello"
+}
+`
+
+// TestEmbeddedServerReleasedOnFailedStart checks that the embedded NATS server is shut down again if the NATS app
+// cannot start (Caddy does not call Stop() in this case).
+func TestEmbeddedServerReleasedOnFailedStart(t *testing.T) {
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(`
+	{
+		default_bind 127.0.0.1
+		http_port 8889
+		admin 127.0.0.1:2999
+	}
+	:8889 {
+		respond /greet "hello"
+	}`, "caddyfile")
+
+	res, err := http.Post("http://127.0.0.1:2999/load", "text/caddyfile", strings.NewReader(embeddedServerFailingCaddyConf))
+	integrationtest.FailOnErr("could not load config: %s", err, t)
+	res.Body.Close()
+
+	res, err = http.Get("http://127.0.0.1:2999/config/apps/nats")
+	integrationtest.FailOnErr("could not read config: %s", err, t)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if strings.TrimSpace(string(body)) != "null" {
+		t.Fatalf("the failing config should have been rolled back. NATS app config: %s", string(body))
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:8371")
+	integrationtest.FailOnErr("embedded NATS server is still running after the failed start: %s", err, t)
+	l.Close()
+}
@@ -1,15 +1,23 @@
 package natsbridge
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 	"github.com/nats-io/nats.go"
 	"github.com/sandstorm/caddy-nats-bridge/common"
 	"go.uber.org/zap"
+	"sync"
+	"time"
 )
 
+// DefaultShutdownGracePeriod is used if no shutdownGracePeriod is configured for a server.
+const DefaultShutdownGracePeriod = 10 * time.Second
+
 // NatsBridgeApp is the natsbridge nats bridge for Caddy.
 //
 // NATS is a simple, secure and performant communications system for digital
@@ -20,6 +28,7 @@ type NatsBridgeApp struct {
 
 	logger *zap.Logger
 	ctx    caddy.Context
+	events *caddyevents.App
 }
 
 type NatsServer struct {
@@ -29,6 +38,10 @@ type NatsServer struct {
 	NkeyCredentialFile string `json:"nkeyCredentialFile,omitempty"`
 	ClientName         string `json:"clientName,omitempty"`
 	InboxPrefix        string `json:"inboxPrefix,omitempty"`
+	// how long to wait for in-flight messages and for draining the connection when Caddy stops or reloads.
+	ShutdownGracePeriod time.Duration `json:"shutdownGracePeriod,omitempty"`
+	// if set, a NATS server is run inside Caddy; if NatsUrl is empty, we connect to it.
+	Embedded *EmbeddedServer `json:"embedded,omitempty"`
 
 	HandlersRaw []json.RawMessage `json:"handle,omitempty" caddy:"namespace=nats.handlers inline_key=handler"`
 
@@ -36,6 +49,10 @@ type NatsServer struct {
 	Handlers []common.NatsHandler `json:"-"`
 
 	Conn *nats.Conn `json:"-"`
+	// closed once the NATS connection is closed (see nats.ClosedHandler)
+	closed chan struct{}
+	// true once the embedded server was started (or re-used) for this config; it must be released in Stop().
+	embeddedStarted bool
 }
 
 // CaddyModule returns the Caddy module information.
@@ -56,8 +73,17 @@ func (app *NatsBridgeApp) Provision(ctx caddy.Context) error {
 	app.ctx = ctx
 	app.logger = ctx.Logger(app)
 
+	eventsAppIface, err := ctx.App("events")
+	if err != nil {
+		return fmt.Errorf("getting events app: %v", err)
+	}
+	app.events = eventsAppIface.(*caddyevents.App)
+
 	// Set up handlers for each server
 	for _, server := range app.Servers {
+		if server.ShutdownGracePeriod == 0 {
+			server.ShutdownGracePeriod = DefaultShutdownGracePeriod
+		}
 		if server.HandlersRaw != nil {
 			vals, err := ctx.LoadModule(server, "HandlersRaw")
 			if err != nil {
@@ -72,10 +98,46 @@ func (app *NatsBridgeApp) Provision(ctx caddy.Context) error {
 	return nil
 }
 
+// Start starts the embedded NATS servers, connects to all NATS servers and subscribes the handlers.
+//
+// Caddy does not call Stop() if Start() failed; so on an error, we release everything which was already started.
 func (app *NatsBridgeApp) Start() error {
+	err := app.start()
+	if err != nil {
+		app.releaseServers()
+	}
+	return err
+}
+
+func (app *NatsBridgeApp) start() error {
 	for _, server := range app.Servers {
+		for _, handler := range server.Handlers {
+			if h, ok := handler.(common.NatsHandlerWithDependencies); ok {
+				err := h.ResolveDependencies()
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for alias, server := range app.Servers {
+		alias := alias
+
+		natsUrl := server.NatsUrl
+		if server.Embedded != nil {
+			ns, err := startEmbeddedServer(alias, server.Embedded, app.logger)
+			if err != nil {
+				return fmt.Errorf("could not start embedded NATS server for %s: %w", alias, err)
+			}
+			server.embeddedStarted = true
+			if natsUrl == "" {
+				natsUrl = ns.ClientURL()
+			}
+		}
+
 		// Connect to the NATS server
-		app.logger.Info("connecting via NATS URL: ", zap.String("natsUrl", server.NatsUrl))
+		app.logger.Info("connecting via NATS URL: ", zap.String("natsUrl", natsUrl))
 
 		var err error
 		var opts []nats.Option
@@ -101,17 +163,45 @@ func (app *NatsBridgeApp) Start() error {
 
 		// we retry forever
 		opts = append(opts, nats.MaxReconnects(-1))
+		opts = append(opts, nats.RetryOnFailedConnect(true))
+
+		// connection lifecycle -> logs and Caddy events
+		opts = append(opts, nats.ConnectHandler(func(conn *nats.Conn) {
+			app.logger.Info("NATS connected", zap.String("server", alias), zap.String("url", conn.ConnectedUrlRedacted()))
+			app.emitEvent("nats.connected", alias, conn, nil, nil)
+		}))
 		opts = append(opts, nats.DisconnectErrHandler(func(conn *nats.Conn, err error) {
-			app.logger.Info("NATS disconnected")
+			// err is nil if we disconnected on purpose (f.e. on shutdown)
+			if err != nil {
+				app.logger.Warn("NATS disconnected", zap.String("server", alias), zap.String("url", conn.ConnectedUrlRedacted()), zap.Error(err))
+			} else {
+				app.logger.Info("NATS disconnected", zap.String("server", alias), zap.String("url", conn.ConnectedUrlRedacted()))
+			}
+			app.emitEvent("nats.disconnected", alias, conn, err, nil)
 		}))
-		opts = append(opts, nats.RetryOnFailedConnect(true))
 		opts = append(opts, nats.ReconnectHandler(func(conn *nats.Conn) {
-			app.logger.Info("NATS reconnected")
+			app.logger.Info("NATS reconnected", zap.String("server", alias), zap.String("url", conn.ConnectedUrlRedacted()))
+			app.emitEvent("nats.reconnected", alias, conn, nil, nil)
+		}))
+		opts = append(opts, nats.ErrorHandler(func(conn *nats.Conn, sub *nats.Subscription, err error) {
+			eventName := "nats.async_error"
+			if errors.Is(err, nats.ErrSlowConsumer) {
+				eventName = "nats.slow_consumer"
+			}
+			app.logger.Error("NATS async error", zap.String("server", alias), zap.Error(err))
+			app.emitEvent(eventName, alias, conn, err, sub)
+		}))
+		closed := make(chan struct{})
+		server.closed = closed
+		opts = append(opts, nats.ClosedHandler(func(conn *nats.Conn) {
+			app.logger.Info("NATS connection closed", zap.String("server", alias))
+			app.emitEvent("nats.closed", alias, conn, conn.LastError(), nil)
+			close(closed)
 		}))
 
-		server.Conn, err = nats.Connect(server.NatsUrl, opts...)
+		server.Conn, err = nats.Connect(natsUrl, opts...)
 		if err != nil {
-			return fmt.Errorf("could not connect to %s : %w", server.NatsUrl, err)
+			return fmt.Errorf("could not connect to %s : %w", natsUrl, err)
 		}
 
 		app.logger.Info("connected to NATS server", zap.String("url", server.Conn.ConnectedUrlRedacted()))
@@ -127,21 +217,138 @@ func (app *NatsBridgeApp) Start() error {
 	return nil
 }
 
+// releaseServers closes the connections opened so far and releases the embedded NATS servers, after Start() failed.
+func (app *NatsBridgeApp) releaseServers() {
+	for alias, server := range app.Servers {
+		if server.Conn != nil {
+			server.Conn.Close()
+			server.Conn = nil
+		}
+		if server.embeddedStarted {
+			err := stopEmbeddedServer(alias)
+			if err != nil {
+				app.logger.Error("could not release embedded NATS server", zap.String("server", alias), zap.Error(err))
+			}
+			server.embeddedStarted = false
+		}
+	}
+}
+
+// ServerConn returns the connection of the NATS server with the given alias, as configured in the NATS app of
+// the given Caddy context.
+//
+// NOTE: this must not be called during Provision() of another module, because the NATS app might not be provisioned
+// yet (and calling ctx.App() while the apps are loaded leads to crashes or provisioning cycles).
+func ServerConn(ctx caddy.Context, serverAlias string) (*nats.Conn, error) {
+	natsAppIface, err := ctx.AppIfConfigured("nats")
+	if err != nil {
+		return nil, fmt.Errorf("getting NATS app: %w. Make sure NATS is configured in nats options", err)
+	}
+	app := natsAppIface.(*NatsBridgeApp)
+	server, ok := app.Servers[serverAlias]
+	if !ok {
+		return nil, fmt.Errorf("NATS server alias %s not found", serverAlias)
+	}
+	if server.Conn == nil {
+		return nil, fmt.Errorf("NATS server alias %s is not connected", serverAlias)
+	}
+	return server.Conn, nil
+}
+
+// emitEvent emits a Caddy event about the connection lifecycle of the given server; so that other modules
+// (and alerting) can react on it. err and sub are optional.
+func (app *NatsBridgeApp) emitEvent(eventName string, alias string, conn *nats.Conn, err error, sub *nats.Subscription) {
+	data := map[string]any{
+		"server": alias,
+		"url":    conn.ConnectedUrlRedacted(),
+	}
+	if err != nil {
+		data["error"] = err.Error()
+	}
+	if sub != nil {
+		data["subject"] = sub.Subject
+	}
+	app.events.Emit(app.ctx, eventName, data)
+}
+
+// Stop shuts down all NATS servers in parallel. For each server, we
+//  1. stop accepting new messages by draining all subscriptions,
+//  2. wait for in-flight messages to be handled, up to the server's ShutdownGracePeriod,
+//  3. drain the NATS connection (flushing pending publishes) and close it,
+//  4. release the embedded NATS server (if any); it keeps running if the new config still uses it.
+//
+// The connections need to be closed here, because a reload of Caddy creates a new NatsBridgeApp with its own
+// connections - so otherwise we would leak a connection on every reload.
 func (app *NatsBridgeApp) Stop() error {
-	// we do NOT close the connections from NATS server, as otherwise we'd disconnect
-	// on a reload of the Caddy server.
+	app.logger.Info("stopping all NATS subscriptions and draining connections")
 
-	app.logger.Info("stopping all NATS subscriptions")
-	for _, server := range app.Servers {
-		for _, handler := range server.Handlers {
-			err := handler.Unsubscribe(server.Conn)
+	var wg sync.WaitGroup
+	errs := make([]error, 0, len(app.Servers))
+	var errsMu sync.Mutex
+	for alias, server := range app.Servers {
+		wg.Add(1)
+		go func(alias string, server *NatsServer) {
+			defer wg.Done()
+			err := app.stopServer(server)
+			if server.embeddedStarted {
+				err = errors.Join(err, stopEmbeddedServer(alias))
+			}
 			if err != nil {
-				return err
+				app.logger.Error("NATS server did not shut down cleanly", zap.String("server", alias), zap.Error(err))
+				errsMu.Lock()
+				errs = append(errs, fmt.Errorf("NATS server %s: %w", alias, err))
+				errsMu.Unlock()
+				return
 			}
+			app.logger.Info("NATS server shut down", zap.String("server", alias))
+		}(alias, server)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// stopServer does the ordered shutdown of a single server, see Stop().
+func (app *NatsBridgeApp) stopServer(server *NatsServer) error {
+	if server.Conn == nil {
+		// Start() did not get to this server.
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), server.ShutdownGracePeriod)
+	defer cancel()
+
+	var errs []error
+	for _, handler := range server.Handlers {
+		err := handler.Unsubscribe(server.Conn)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, handler := range server.Handlers {
+		err := handler.Wait(ctx)
+		if err != nil {
+			errs = append(errs, err)
 		}
 	}
 
-	return nil
+	err := server.Conn.Drain()
+	if err != nil {
+		// while reconnecting, the connection cannot be drained; so pending publishes are lost, like on a disconnect.
+		server.Conn.Close()
+		if !errors.Is(err, nats.ErrConnectionClosed) && !errors.Is(err, nats.ErrConnectionReconnecting) {
+			errs = append(errs, fmt.Errorf("could not drain connection: %w", err))
+		}
+		return errors.Join(errs...)
+	}
+	select {
+	case <-server.closed:
+	case <-ctx.Done():
+		server.Conn.Close()
+		errs = append(errs, fmt.Errorf("connection not drained within %s: %w", server.ShutdownGracePeriod, ctx.Err()))
+	}
+
+	return errors.Join(errs...)
 }
 
 // Interface guards
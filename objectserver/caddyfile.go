@@ -0,0 +1,59 @@
+package objectserver
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// ParseObjectServerHandler parses the nats_object_server directive. Syntax:
+//
+//	nats_object_server [matcher] [serverAlias] bucket {
+//	    [index index.html...]
+//	    [browse]
+//	    [upload]
+//	}
+func ParseObjectServerHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var o = ObjectServer{}
+	err := o.UnmarshalCaddyfile(h.Dispenser)
+	return o, err
+}
+
+func (o *ObjectServer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.CountRemainingArgs() == 2 {
+			if !d.Args(&o.ServerAlias, &o.Bucket) {
+				// should never fail because of the check above for remainingArgs==2
+				return d.Errf("Wrong argument count or unexpected line ending after '%s'", d.Val())
+			}
+		} else {
+			if !d.Args(&o.Bucket) {
+				return d.Errf("Wrong argument count or unexpected line ending after '%s'", d.Val())
+			}
+		}
+
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "index":
+				o.IndexNames = d.RemainingArgs()
+				if len(o.IndexNames) == 0 {
+					return d.ArgErr()
+				}
+			case "browse":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				o.Browse = true
+			case "upload":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				o.Upload = true
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package objectserver
+
+import (
+	"html/template"
+	"time"
+)
+
+// listing is a directory listing of the object store, rendered as HTML or JSON.
+type listing struct {
+	Path    string
+	Entries []listingEntry
+}
+
+type listingEntry struct {
+	// relative to the directory; ends with a slash for sub directories.
+	Name    string    `json:"name"`
+	IsDir   bool      `json:"isDir,omitempty"`
+	Size    uint64    `json:"size,omitempty"`
+	ModTime time.Time `json:"modTime,omitempty"`
+	Digest  string    `json:"digest,omitempty"`
+	// bucket/name of the linked object, for links.
+	Link string `json:"link,omitempty"`
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>{{.Path}}</title>
+</head>
+<body>
+	<h1>{{.Path}}</h1>
+	<table>
+		<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+		{{- if ne .Path "/"}}
+		<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+		{{- end}}
+		{{- range .Entries}}
+		<tr>
+			<td><a href="./{{.Name}}">{{.Name}}</a>{{if .Link}} &rarr; {{.Link}}{{end}}</td>
+			<td>{{if not .IsDir}}{{.Size}}{{end}}</td>
+			<td>{{if not .IsDir}}{{.ModTime.UTC.Format "2006-01-02 15:04:05"}}{{end}}</td>
+		</tr>
+		{{- end}}
+	</table>
+</body>
+</html>
+`))
@@ -0,0 +1,85 @@
+package objectserver
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"io"
+)
+
+// objectReader makes an object seekable for http.ServeContent, without buffering it: objects are streamed in chunks
+// from NATS, so skipping forward discards data, and seeking backwards re-opens the object.
+type objectReader struct {
+	store nats.ObjectStore
+	name  string
+	ctx   context.Context
+	size  int64
+
+	// the requested read position.
+	offset int64
+	// the open object, and its read position.
+	result nats.ObjectResult
+	pos    int64
+}
+
+func (or *objectReader) Read(p []byte) (int, error) {
+	if or.offset >= or.size {
+		return 0, io.EOF
+	}
+	if or.result == nil || or.pos > or.offset {
+		err := or.reopen()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if or.pos < or.offset {
+		n, err := io.CopyN(io.Discard, or.result, or.offset-or.pos)
+		or.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := or.result.Read(p)
+	or.pos += int64(n)
+	or.offset += int64(n)
+	return n, err
+}
+
+func (or *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += or.offset
+	case io.SeekEnd:
+		offset += or.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	or.offset = offset
+	return offset, nil
+}
+
+func (or *objectReader) reopen() error {
+	if or.result != nil {
+		_ = or.result.Close()
+	}
+	result, err := or.store.Get(or.name, nats.Context(or.ctx))
+	if err != nil {
+		or.result = nil
+		return err
+	}
+	or.result = result
+	or.pos = 0
+	return nil
+}
+
+func (or *objectReader) Close() error {
+	if or.result == nil {
+		return nil
+	}
+	return or.result.Close()
+}
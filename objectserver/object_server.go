@@ -0,0 +1,315 @@
+package objectserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/nats-io/nats.go"
+	"github.com/sandstorm/caddy-nats-bridge/natsbridge"
+	"go.uber.org/zap"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// ObjectServer serves the objects of a JetStream Object Store bucket like static files; the object name is the request
+// path without leading slash (use handle_path to strip a prefix). Object names containing slashes are treated like
+// files in directories.
+//
+// Range and conditional requests are supported; the object digest is used as ETag, and its modification time as
+// Last-Modified. The Content-Type is taken from the Content-Type header of the object, or detected from the name or
+// content. Links to single objects (also in other buckets) are followed.
+type ObjectServer struct {
+	Bucket      string `json:"bucket,omitempty"`
+	ServerAlias string `json:"serverAlias,omitempty"`
+	// names of the objects served for directory requests (paths ending with a slash); index.html if not set.
+	IndexNames []string `json:"indexNames,omitempty"`
+	// lists the objects of directories without index object.
+	Browse bool `json:"browse,omitempty"`
+	// allows uploading objects via PUT.
+	Upload bool `json:"upload,omitempty"`
+
+	logger *zap.Logger
+	app    *natsbridge.NatsBridgeApp
+	// do not use directly, but always use objectStore() to access, to ensure it is initialized.
+	store *atomic.Pointer[nats.ObjectStore]
+}
+
+func (ObjectServer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.nats_object_server",
+		New: func() caddy.Module {
+			// Default values
+			return &ObjectServer{
+				ServerAlias: "default",
+			}
+		},
+	}
+}
+
+func (o *ObjectServer) Provision(ctx caddy.Context) error {
+	o.logger = ctx.Logger(o)
+
+	natsAppIface, err := ctx.App("nats")
+	if err != nil {
+		return fmt.Errorf("getting NATS app: %v. Make sure NATS is configured in nats options", err)
+	}
+	o.app = natsAppIface.(*natsbridge.NatsBridgeApp)
+
+	if o.Bucket == "" {
+		return fmt.Errorf("bucket is required")
+	}
+	if len(o.IndexNames) == 0 {
+		o.IndexNames = []string{"index.html"}
+	}
+	o.store = &atomic.Pointer[nats.ObjectStore]{}
+	return nil
+}
+
+func (o ObjectServer) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+
+	var allowed bool
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		allowed = true
+	case http.MethodPut:
+		allowed = o.Upload
+	}
+	if !allowed {
+		if o.Upload {
+			w.Header().Set("Allow", "GET, HEAD, PUT")
+		} else {
+			w.Header().Set("Allow", "GET, HEAD")
+		}
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+
+	store, err := o.objectStore()
+	if err != nil {
+		return caddyhttp.Error(http.StatusServiceUnavailable, err)
+	}
+
+	if r.Method == http.MethodPut {
+		return o.upload(w, r, store, name)
+	}
+	if name == "" || strings.HasSuffix(name, "/") {
+		return o.serveDirectory(w, r, store, name)
+	}
+	return o.serveObject(w, r, store, name)
+}
+
+func (o ObjectServer) serveObject(w http.ResponseWriter, r *http.Request, store nats.ObjectStore, name string) error {
+	// only the info is loaded here, so that missing objects are detected before anything is written; the object itself
+	// is opened lazily by the reader - so it is not read at all for HEAD and 304 Not Modified responses.
+	info, err := o.objectInfo(r, store, name)
+	if errors.Is(err, nats.ErrObjectNotFound) && o.isDirectory(r, store, name) {
+		// like file_server: directories are only served with a trailing slash.
+		http.Redirect(w, r, originalPath(r)+"/", http.StatusPermanentRedirect)
+		return nil
+	}
+	if err != nil {
+		return objectError(err)
+	}
+
+	reader := &objectReader{
+		store: store,
+		name:  name,
+		ctx:   r.Context(),
+		size:  int64(info.Size),
+	}
+	defer reader.Close()
+
+	contentType := info.Headers.Get("Content-Type")
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(name))
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if info.Digest != "" {
+		w.Header().Set("ETag", `"`+info.Digest+`"`)
+	}
+
+	// handles Range, If-Range, If-None-Match, If-Modified-Since, HEAD and content type sniffing.
+	http.ServeContent(w, r, name, info.ModTime, reader)
+	return nil
+}
+
+func (o ObjectServer) serveDirectory(w http.ResponseWriter, r *http.Request, store nats.ObjectStore, prefix string) error {
+	for _, index := range o.IndexNames {
+		_, err := store.GetInfo(prefix+index, nats.Context(r.Context()))
+		if err == nil {
+			return o.serveObject(w, r, store, prefix+index)
+		}
+		if !errors.Is(err, nats.ErrObjectNotFound) {
+			return objectError(err)
+		}
+	}
+	if !o.Browse {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("no index object for %s", prefix))
+	}
+
+	entries, err := o.list(r, store, prefix)
+	if err != nil {
+		return objectError(err)
+	}
+	if prefix != "" && len(entries) == 0 {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("directory %s not found", prefix))
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(entries)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return listingTemplate.Execute(w, listing{Path: originalPath(r), Entries: entries})
+}
+
+// list returns the entries of the directory prefix: objects directly in it, and sub directories.
+func (o ObjectServer) list(r *http.Request, store nats.ObjectStore, prefix string) ([]listingEntry, error) {
+	infos, err := store.List(nats.Context(r.Context()))
+	if errors.Is(err, nats.ErrNoObjectsFound) {
+		return []listingEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []listingEntry{}
+	directories := map[string]bool{}
+	for _, info := range infos {
+		rest, ok := strings.CutPrefix(info.Name, prefix)
+		// links to whole buckets cannot be served.
+		if !ok || rest == "" || info.Deleted || (info.Opts != nil && info.Opts.Link != nil && info.Opts.Link.Name == "") {
+			continue
+		}
+		if dir, _, isDir := strings.Cut(rest, "/"); isDir {
+			if !directories[dir] {
+				directories[dir] = true
+				entries = append(entries, listingEntry{Name: dir + "/", IsDir: true})
+			}
+			continue
+		}
+		entry := listingEntry{Name: rest, Size: info.Size, ModTime: info.ModTime, Digest: info.Digest}
+		if info.Opts != nil && info.Opts.Link != nil {
+			entry.Link = info.Opts.Link.Bucket + "/" + info.Opts.Link.Name
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// objectInfo returns the info of the object, without reading it; for links, the info of the target object.
+func (o ObjectServer) objectInfo(r *http.Request, store nats.ObjectStore, name string) (*nats.ObjectInfo, error) {
+	info, err := store.GetInfo(name, nats.Context(r.Context()))
+	if err != nil || info.Opts == nil || info.Opts.Link == nil {
+		return info, err
+	}
+
+	link := info.Opts.Link
+	if link.Name == "" {
+		// links to whole buckets cannot be served.
+		return nil, nats.ErrCantGetBucket
+	}
+	if link.Bucket != o.Bucket {
+		js, err := o.app.Servers[o.ServerAlias].Conn.JetStream()
+		if err != nil {
+			return nil, fmt.Errorf("could not load JetStream: %w", err)
+		}
+		store, err = js.ObjectStore(link.Bucket)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return store.GetInfo(link.Name, nats.Context(r.Context()))
+}
+
+// isDirectory returns whether there are objects below name/.
+func (o ObjectServer) isDirectory(r *http.Request, store nats.ObjectStore, name string) bool {
+	entries, err := o.list(r, store, name+"/")
+	return err == nil && len(entries) > 0
+}
+
+func (o ObjectServer) upload(w http.ResponseWriter, r *http.Request, store nats.ObjectStore, name string) error {
+	if name == "" || strings.HasSuffix(name, "/") {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("cannot upload to directory %s", name))
+	}
+	meta := &nats.ObjectMeta{Name: name}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		meta.Headers = nats.Header{}
+		meta.Headers.Set("Content-Type", contentType)
+	}
+	info, err := store.Put(meta, r.Body, nats.Context(r.Context()))
+	if err != nil {
+		return objectError(err)
+	}
+
+	o.logger.Debug("uploaded object", zap.String("bucket", o.Bucket), zap.String("name", name), zap.Uint64("size", info.Size))
+	w.Header().Set("ETag", `"`+info.Digest+`"`)
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// objectStore is lazily loading the object store on first access; the bucket is not created, as it should be
+// provisioned explicitly before it is served.
+func (o ObjectServer) objectStore() (nats.ObjectStore, error) {
+	tmp := o.store.Load()
+	if tmp != nil {
+		return *tmp, nil
+	}
+
+	server, ok := o.app.Servers[o.ServerAlias]
+	if !ok {
+		return nil, fmt.Errorf("NATS server alias %s not found", o.ServerAlias)
+	}
+	js, err := server.Conn.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("could not load JetStream: %w", err)
+	}
+	store, err := js.ObjectStore(o.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("could not load ObjectStore for bucket %s: %w", o.Bucket, err)
+	}
+
+	o.store.Store(&store)
+	return store, nil
+}
+
+// objectError maps errors of the object store to HTTP errors.
+func objectError(err error) error {
+	switch {
+	case errors.Is(err, nats.ErrObjectNotFound), errors.Is(err, nats.ErrCantGetBucket):
+		return caddyhttp.Error(http.StatusNotFound, err)
+	case errors.Is(err, nats.ErrBadObjectMeta), errors.Is(err, nats.ErrInvalidStoreName):
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	default:
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+}
+
+// originalPath returns the request path before handle_path or rewrites; for redirects and listings.
+func originalPath(r *http.Request) string {
+	if orig, ok := r.Context().Value(caddyhttp.OriginalRequestCtxKey).(http.Request); ok {
+		return orig.URL.Path
+	}
+	return r.URL.Path
+}
+
+var (
+	_ caddyhttp.MiddlewareHandler = (*ObjectServer)(nil)
+	_ caddy.Provisioner           = (*ObjectServer)(nil)
+	_ caddyfile.Unmarshaler       = (*ObjectServer)(nil)
+)
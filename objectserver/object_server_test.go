@@ -0,0 +1,209 @@
+package objectserver_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	_ "github.com/sandstorm/caddy-nats-bridge"
+	"github.com/sandstorm/caddy-nats-bridge/integrationtest"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestObjectServer serves objects incl. Range and conditional requests, links, directory listings and uploads.
+func TestObjectServer(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	js := tn.ResetJetStream(t)
+	store, err := js.CreateObjectStore(&nats.ObjectStoreConfig{Bucket: "artifacts"})
+	integrationtest.FailOnErr("could not create object store: %s", err, t)
+
+	// larger than a single chunk (128 KiB), to test ranges across chunks.
+	artifact := make([]byte, 300_000)
+	for i := range artifact {
+		artifact[i] = byte(i % 251)
+	}
+	_, err = store.PutBytes("index.html", []byte("<h1>Builds</h1>"))
+	integrationtest.FailOnErr("could not put object: %s", err, t)
+	_, err = store.PutBytes("builds/app.tar.gz", artifact)
+	integrationtest.FailOnErr("could not put object: %s", err, t)
+	notes, err := store.PutString("builds/notes.txt", "release notes")
+	integrationtest.FailOnErr("could not put object: %s", err, t)
+	artifactInfo, err := store.GetInfo("builds/app.tar.gz")
+	integrationtest.FailOnErr("could not get object info: %s", err, t)
+	_, err = store.AddLink("builds/latest", artifactInfo)
+	integrationtest.FailOnErr("could not add link: %s", err, t)
+
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			handle_path /files/* {
+				route {
+					nats_object_server artifacts {
+						browse
+						upload
+					}
+				}
+			}
+		}
+	`, ""), "caddyfile")
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	doRequest := func(method string, path string, body string, header map[string]string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, "http://localhost:8889"+path, strings.NewReader(body))
+		integrationtest.FailOnErr("could not create request: %s", err, t)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		res, err := client.Do(req)
+		integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		integrationtest.FailOnErr("could not read response body: %s", err, t)
+		return res, b
+	}
+	assertStatus := func(description string, res *http.Response, expected int) {
+		if res.StatusCode != expected {
+			t.Fatalf("%s: wrong status. Expected: %d. Actual: %d", description, expected, res.StatusCode)
+		}
+	}
+
+	t.Run("index object for directories", func(t *testing.T) {
+		res, b := doRequest("GET", "/files/", "", nil)
+		assertStatus("index", res, 200)
+		if string(b) != "<h1>Builds</h1>" || res.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Fatalf("wrong index response: %s %+v", b, res.Header)
+		}
+	})
+
+	t.Run("object with ETag, Last-Modified and Content-Type", func(t *testing.T) {
+		res, b := doRequest("GET", "/files/builds/notes.txt", "", nil)
+		assertStatus("object", res, 200)
+		if string(b) != "release notes" {
+			t.Fatalf("wrong body: %s", b)
+		}
+		if res.Header.Get("ETag") != `"`+notes.Digest+`"` || res.Header.Get("Last-Modified") == "" || res.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+			t.Fatalf("wrong headers: %+v", res.Header)
+		}
+
+		res, _ = doRequest("GET", "/files/builds/notes.txt", "", map[string]string{"If-None-Match": `"` + notes.Digest + `"`})
+		assertStatus("conditional request", res, 304)
+	})
+
+	t.Run("HEAD and 304 do not read the object", func(t *testing.T) {
+		// reading an object creates a consumer on the stream of the bucket.
+		consumerCreates, err := tn.ClientConn.SubscribeSync("$JS.API.CONSUMER.>")
+		integrationtest.FailOnErr("error subscribing: %s", err, t)
+		defer consumerCreates.Unsubscribe()
+		objectReads := func() int {
+			integrationtest.FailOnErr("could not flush: %s", tn.ClientConn.Flush(), t)
+			reads := 0
+			for {
+				msg, err := consumerCreates.NextMsg(100 * time.Millisecond)
+				if err != nil {
+					return reads
+				}
+				if strings.HasPrefix(msg.Subject, "$JS.API.CONSUMER.CREATE.OBJ_artifacts") {
+					reads++
+				}
+			}
+		}
+
+		res, b := doRequest("HEAD", "/files/builds/app.tar.gz", "", nil)
+		assertStatus("HEAD", res, 200)
+		if len(b) != 0 || res.Header.Get("Content-Length") != "300000" || res.Header.Get("ETag") != `"`+artifactInfo.Digest+`"` {
+			t.Fatalf("wrong HEAD response: %+v", res.Header)
+		}
+		res, _ = doRequest("GET", "/files/builds/latest", "", map[string]string{"If-None-Match": `"` + artifactInfo.Digest + `"`})
+		assertStatus("conditional request for link", res, 304)
+		if reads := objectReads(); reads != 0 {
+			t.Fatalf("HEAD and 304 responses must not read the object, reads: %d", reads)
+		}
+
+		res, _ = doRequest("GET", "/files/builds/notes.txt", "", nil)
+		assertStatus("GET", res, 200)
+		if reads := objectReads(); reads != 1 {
+			t.Fatalf("GET must read the object once, reads: %d", reads)
+		}
+	})
+
+	t.Run("range requests", func(t *testing.T) {
+		for _, r := range [][2]int{{0, 9}, {200_000, 200_009}, {299_990, 299_999}} {
+			res, b := doRequest("GET", "/files/builds/app.tar.gz", "", map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", r[0], r[1])})
+			assertStatus("range", res, 206)
+			if !bytes.Equal(b, artifact[r[0]:r[1]+1]) {
+				t.Fatalf("wrong range %v: %v", r, b)
+			}
+		}
+		res, b := doRequest("GET", "/files/builds/app.tar.gz", "", nil)
+		assertStatus("full object", res, 200)
+		if !bytes.Equal(b, artifact) {
+			t.Fatalf("wrong full object, length %d", len(b))
+		}
+	})
+
+	t.Run("links", func(t *testing.T) {
+		res, b := doRequest("GET", "/files/builds/latest", "", nil)
+		assertStatus("link", res, 200)
+		if !bytes.Equal(b, artifact) || res.Header.Get("ETag") != `"`+artifactInfo.Digest+`"` {
+			t.Fatalf("link not resolved: %+v", res.Header)
+		}
+	})
+
+	t.Run("directory listing", func(t *testing.T) {
+		res, _ := doRequest("GET", "/files/builds", "", nil)
+		assertStatus("redirect", res, 308)
+		if res.Header.Get("Location") != "/files/builds/" {
+			t.Fatalf("wrong redirect: %s", res.Header.Get("Location"))
+		}
+
+		res, b := doRequest("GET", "/files/builds/", "", map[string]string{"Accept": "application/json"})
+		assertStatus("JSON listing", res, 200)
+		var entries []struct {
+			Name string `json:"name"`
+			Link string `json:"link"`
+		}
+		integrationtest.FailOnErr("invalid JSON listing: %s", json.Unmarshal(b, &entries), t)
+		if len(entries) != 3 || entries[0].Name != "app.tar.gz" || entries[1].Name != "latest" || entries[1].Link != "artifacts/builds/app.tar.gz" || entries[2].Name != "notes.txt" {
+			t.Fatalf("wrong listing: %s", b)
+		}
+
+		res, b = doRequest("GET", "/files/builds/", "", nil)
+		assertStatus("HTML listing", res, 200)
+		if !strings.Contains(string(b), `<a href="./notes.txt">notes.txt</a>`) {
+			t.Fatalf("wrong HTML listing: %s", b)
+		}
+	})
+
+	t.Run("upload", func(t *testing.T) {
+		res, _ := doRequest("PUT", "/files/uploads/new.txt", "uploaded", map[string]string{"Content-Type": "text/markdown"})
+		assertStatus("upload", res, 201)
+		res, b := doRequest("GET", "/files/uploads/new.txt", "", nil)
+		assertStatus("uploaded object", res, 200)
+		if string(b) != "uploaded" || res.Header.Get("Content-Type") != "text/markdown" {
+			t.Fatalf("wrong uploaded object: %s %+v", b, res.Header)
+		}
+	})
+
+	t.Run("unlisted methods", func(t *testing.T) {
+		for _, method := range []string{"DELETE", "POST", "GE"} {
+			res, _ := doRequest(method, "/files/builds/notes.txt", "", nil)
+			assertStatus(method, res, 405)
+			if res.Header.Get("Allow") != "GET, HEAD, PUT" {
+				t.Fatalf("%s: wrong Allow header: %s", method, res.Header.Get("Allow"))
+			}
+		}
+	})
+
+	t.Run("missing object", func(t *testing.T) {
+		res, _ := doRequest("GET", "/files/missing.txt", "", nil)
+		assertStatus("missing", res, 404)
+	})
+}
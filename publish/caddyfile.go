@@ -4,12 +4,22 @@ import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/sandstorm/caddy-nats-bridge/common"
 )
 
 // ParsePublishHandler parses the nats_publish directive. Syntax:
 //
 //	nats_publish [serverAlias] subject {
-//	    [timeout 42ms]
+//	    [headers {
+//	        # see common.ParseHeaderPolicy
+//	    }]
+//	    [format raw|json|cloudevents [{
+//	        # see common.ParseMessageFormat
+//	    }]]
+//	    [compress gzip|zstd|s2 [min_size]]
+//	    [encrypt aes-gcm|nacl-box {
+//	        # see common.ParseEncryption
+//	    }]
 //	}
 func ParsePublishHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var p = Publish{}
@@ -31,6 +41,30 @@ func (p *Publish) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 		for d.NextBlock(0) {
 			switch d.Val() {
+			case "headers":
+				headers, err := common.ParseHeaderPolicy(d)
+				if err != nil {
+					return err
+				}
+				p.Headers = headers
+			case "format":
+				format, err := common.ParseMessageFormat(d)
+				if err != nil {
+					return err
+				}
+				p.FormatRaw = format
+			case "compress":
+				compress, err := common.ParseCompression(d)
+				if err != nil {
+					return err
+				}
+				p.Compress = compress
+			case "encrypt":
+				encrypt, err := common.ParseEncryption(d)
+				if err != nil {
+					return err
+				}
+				p.Encrypt = encrypt
 			default:
 				return d.Errf("unrecognized subdirective: %s", d.Val())
 			}
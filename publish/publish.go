@@ -1,6 +1,7 @@
 package publish
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -14,7 +15,16 @@ import (
 type Publish struct {
 	Subject     string `json:"subject,omitempty"`
 	ServerAlias string `json:"serverAlias,omitempty"`
-
+	// filters and modifies the HTTP request headers transferred to the NATS message.
+	Headers *common.HeaderPolicy `json:"headers,omitempty"`
+	// how the HTTP request is represented as NATS message; raw if not set.
+	FormatRaw json.RawMessage `json:"format,omitempty" caddy:"namespace=nats.formats inline_key=format"`
+	// compresses the NATS message payload; not compressed if not set.
+	Compress *common.Compression `json:"compress,omitempty"`
+	// encrypts the NATS message payload; not encrypted if not set.
+	Encrypt *common.Encryption `json:"encrypt,omitempty"`
+
+	format common.MessageFormat
 	logger *zap.Logger
 	app    *natsbridge.NatsBridgeApp
 }
@@ -41,6 +51,23 @@ func (p *Publish) Provision(ctx caddy.Context) error {
 
 	p.app = natsAppIface.(*natsbridge.NatsBridgeApp)
 
+	err = p.Compress.Validate()
+	if err != nil {
+		return err
+	}
+	err = p.Encrypt.Provision()
+	if err != nil {
+		return err
+	}
+
+	if p.FormatRaw != nil {
+		val, err := ctx.LoadModule(p, "FormatRaw")
+		if err != nil {
+			return fmt.Errorf("loading format module: %v", err)
+		}
+		p.format = val.(common.MessageFormat)
+	}
+
 	return nil
 }
 
@@ -62,6 +89,21 @@ func (p Publish) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhtt
 	if err != nil {
 		return err
 	}
+	p.Headers.Apply(http.Header(msg.Header), repl)
+	if p.format != nil {
+		msg, err = p.format.Encode(msg, r, repl)
+		if err != nil {
+			return fmt.Errorf("could not encode NATS message: %w", err)
+		}
+	}
+	err = p.Compress.Compress(msg)
+	if err != nil {
+		return err
+	}
+	err = p.Encrypt.Encrypt(msg)
+	if err != nil {
+		return err
+	}
 
 	err = server.Conn.PublishMsg(msg)
 	if err != nil {
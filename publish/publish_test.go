@@ -2,9 +2,11 @@ package publish_test
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"github.com/nats-io/nats.go"
 	_ "github.com/sandstorm/caddy-nats-bridge"
+	"github.com/sandstorm/caddy-nats-bridge/format"
 	"github.com/sandstorm/caddy-nats-bridge/integrationtest"
 	"net/http"
 	"strings"
@@ -132,6 +134,78 @@ func TestPublishToNats(t *testing.T) {
 				}
 			},
 		},
+		{
+			description: "headers policy should filter and set headers, but keep the X-NatsBridge headers",
+			buildHttpRequest: func(t *testing.T) *http.Request {
+				req, err := http.NewRequest("GET", "http://localhost:8889/test/hi", nil)
+				integrationtest.FailOnErr("Error creating request: %w", err, t)
+
+				req.Header.Add("Cookie", "secret=1")
+				req.Header.Add("X-Trace-Id", "abc")
+				req.Header.Add("Custom-Header", "MyValue")
+				return req
+			},
+			CaddyfileSnippet: `
+				route /test/* {
+					nats_publish greet.hello {
+						headers {
+							deny Cookie
+							rename X-Trace-Id X-Request-Id
+							set X-Source caddy-{http.request.method}
+						}
+					}
+				}
+			`,
+			assertNatsMessage: func(msg *nats.Msg, nc *nats.Conn, t *testing.T) {
+				if msg.Header.Get("Cookie") != "" {
+					t.Fatalf("Cookie header should have been removed, actual headers: %+v", msg.Header)
+				}
+				if msg.Header.Get("X-Request-Id") != "abc" || msg.Header.Get("X-Trace-Id") != "" {
+					t.Fatalf("X-Trace-Id should have been renamed to X-Request-Id, actual headers: %+v", msg.Header)
+				}
+				if msg.Header.Get("X-Source") != "caddy-GET" {
+					t.Fatalf("X-Source not correct, expected 'caddy-GET', actual headers: %+v", msg.Header)
+				}
+				if msg.Header.Get("Custom-Header") != "MyValue" {
+					t.Fatalf("Custom-Header not correct, expected 'MyValue', actual headers: %+v", msg.Header)
+				}
+				if msg.Header.Get("X-NatsBridge-Method") != "GET" {
+					t.Fatalf("X-NatsBridge-Method not correct, expected 'GET', actual headers: %+v", msg.Header)
+				}
+			},
+		},
+		{
+			description: "format json should wrap the request into a JSON envelope",
+			buildHttpRequest: func(t *testing.T) *http.Request {
+				req, err := http.NewRequest("POST", "http://localhost:8889/test/hi?a=1", strings.NewReader("Hello"))
+				integrationtest.FailOnErr("Error creating request: %w", err, t)
+
+				req.Header.Add("Custom-Header", "MyValue")
+				return req
+			},
+			CaddyfileSnippet: `
+				route /test/* {
+					nats_publish greet.hello {
+						format json
+					}
+				}
+			`,
+			assertNatsMessage: func(msg *nats.Msg, nc *nats.Conn, t *testing.T) {
+				var env format.Envelope
+				err := json.Unmarshal(msg.Data, &env)
+				integrationtest.FailOnErr("message data is no JSON envelope: %w", err, t)
+
+				if env.Method != "POST" || env.URL != "http://localhost:8889/test/hi?a=1" {
+					t.Fatalf("method or url not correct, actual envelope: %+v", env)
+				}
+				if env.Headers.Get("Custom-Header") != "MyValue" || string(env.Body) != "Hello" {
+					t.Fatalf("headers or body not correct, actual envelope: %+v", env)
+				}
+				if msg.Header.Get("Content-Type") != "application/json" || msg.Header.Get("X-NatsBridge-Method") != "" {
+					t.Fatalf("message must only have a Content-Type header, actual headers: %+v", msg.Header)
+				}
+			},
+		},
 		// WILDCARDS!!
 	}
 
@@ -0,0 +1,364 @@
+package request
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCacheKey is the key template of a Cache, if not configured otherwise.
+const DefaultCacheKey = "{http.request.host}{http.request.uri}"
+
+// cacheRetryInterval is the time to wait before loading the KV bucket again, if it could not be loaded; so that an
+// unavailable JetStream does not slow down every request.
+const cacheRetryInterval = 30 * time.Second
+
+// Cache stores replies to GET requests in a JetStream KV bucket, and serves GET and HEAD requests from it without a
+// NATS round trip. As the bucket is shared, all Caddy nodes connected to the same NATS share the cache.
+//
+// Replies are cached for TTL, unless their Cache-Control header says otherwise: no-store, no-cache and private replies
+// are not cached, and max-age / s-maxage shorten the TTL. Replies with Set-Cookie header are never cached. Requests with Authorization or Cookie header are neither
+// served from nor stored in the cache, unless the reply is explicitly cacheable by shared caches (public or s-maxage).
+// Replies with a Vary header are cached per value of the listed request headers; "Vary: *" replies are not cached.
+// Conditional requests (If-None-Match) are answered with 304 if the ETag of the reply matches.
+type Cache struct {
+	Bucket string `json:"bucket,omitempty"`
+	// template for the cache key, built from placeholders; DefaultCacheKey if not set.
+	Key string `json:"key,omitempty"`
+	// maximum time a reply is cached; also the TTL of the bucket if it is created.
+	TTL time.Duration `json:"ttl,omitempty"`
+
+	logger *zap.Logger
+	// do not use directly, but always use keyValue() to access, to ensure it is initialized.
+	kv atomic.Pointer[nats.KeyValue]
+	// guards loading the KV bucket; after a failure, it is not loaded again before retryAt.
+	kvMu    sync.Mutex
+	retryAt time.Time
+}
+
+// cacheEntry is a cached reply, as stored in the KV bucket. For replies with a Vary header, the entry of the cache key
+// only lists the Vary'd request headers; the replies are stored under variantKey.
+type cacheEntry struct {
+	Header  http.Header `json:"header"`
+	Body    []byte      `json:"body"`
+	Vary    []string    `json:"vary,omitempty"`
+	Stored  time.Time   `json:"stored"`
+	Expires time.Time   `json:"expires"`
+}
+
+// Provision validates the configuration; a nil Cache is valid.
+func (c *Cache) Provision(logger *zap.Logger) error {
+	if c == nil {
+		return nil
+	}
+	if c.Bucket == "" {
+		return fmt.Errorf("cache: bucket is required")
+	}
+	if c.TTL <= 0 {
+		return fmt.Errorf("cache: ttl must be positive")
+	}
+	if c.Key == "" {
+		c.Key = DefaultCacheKey
+	}
+	c.logger = logger
+	return nil
+}
+
+// keyValue is lazily initializing the KV bucket on first access; as the NATS connection is not available during
+// Provision (see StoreBodyToJetStream.objectStore). If this fails, the cache is skipped for cacheRetryInterval; the
+// failure is only logged here.
+func (c *Cache) keyValue(conn *nats.Conn) (nats.KeyValue, bool) {
+	tmp := c.kv.Load()
+	if tmp != nil {
+		return *tmp, true
+	}
+
+	c.kvMu.Lock()
+	defer c.kvMu.Unlock()
+	tmp = c.kv.Load()
+	if tmp != nil {
+		return *tmp, true
+	}
+	if time.Now().Before(c.retryAt) {
+		return nil, false
+	}
+
+	kv, err := c.loadKeyValue(conn)
+	if err != nil {
+		c.retryAt = time.Now().Add(cacheRetryInterval)
+		c.logger.Warn("cache not available", zap.Duration("retry_in", cacheRetryInterval), zap.Error(err))
+		return nil, false
+	}
+
+	c.kv.Store(&kv)
+	return kv, true
+}
+
+// loadKeyValue loads the KV bucket, and creates it if it does not exist.
+func (c *Cache) loadKeyValue(conn *nats.Conn) (nats.KeyValue, error) {
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("could not load JetStream: %w", err)
+	}
+	kv, err := js.KeyValue(c.Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		c.logger.Info("Creating KV bucket for cache", zap.String("Bucket", c.Bucket), zap.Duration("TTL", c.TTL))
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket: c.Bucket,
+			TTL:    c.TTL,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not load KV bucket %s: %w", c.Bucket, err)
+	}
+	return kv, nil
+}
+
+// key resolves the key template; hashed, as KV keys are limited to a few characters.
+func (c *Cache) key(repl *caddy.Replacer) string {
+	sum := sha256.Sum256([]byte(repl.ReplaceAll(c.Key, "")))
+	return hex.EncodeToString(sum[:])
+}
+
+// variantKey returns the key of the reply for the values of the Vary'd request headers.
+func variantKey(key string, vary []string, r *http.Request) string {
+	h := sha256.New()
+	h.Write([]byte(key))
+	for _, name := range vary {
+		fmt.Fprintf(h, "\n%s: %s", name, strings.Join(r.Header.Values(name), ", "))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns the cached, not yet expired reply for the request; or nil. Errors are logged, and treated as cache miss;
+// the cache must never break requests.
+func (c *Cache) get(conn *nats.Conn, key string, r *http.Request) *cacheEntry {
+	entry := c.load(conn, key)
+	if entry != nil && len(entry.Vary) > 0 {
+		entry = c.load(conn, variantKey(key, entry.Vary, r))
+	}
+	if entry == nil || (authenticated(r) && !sharedCacheable(entry.Header)) {
+		return nil
+	}
+	return entry
+}
+
+// load returns the not yet expired entry of the key; or nil.
+func (c *Cache) load(conn *nats.Conn, key string) *cacheEntry {
+	kv, ok := c.keyValue(conn)
+	if !ok {
+		return nil
+	}
+	kve, err := kv.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		c.logger.Warn("could not read from cache", zap.String("key", key), zap.Error(err))
+		return nil
+	}
+
+	entry := &cacheEntry{}
+	err = json.Unmarshal(kve.Value(), entry)
+	if err != nil {
+		c.logger.Warn("invalid cache entry", zap.String("key", key), zap.Error(err))
+		return nil
+	}
+	if time.Now().After(entry.Expires) {
+		return nil
+	}
+	return entry
+}
+
+// put caches the reply to the request, if its Cache-Control and Vary headers allow it.
+func (c *Cache) put(conn *nats.Conn, key string, r *http.Request, reply http.Header, body []byte) {
+	// NATS headers are case-sensitive; so they are canonicalized like HTTP headers first.
+	header := http.Header{}
+	for k, values := range reply {
+		for _, v := range values {
+			header.Add(k, v)
+		}
+	}
+	if (authenticated(r) && !sharedCacheable(header)) || header.Get("Set-Cookie") != "" {
+		return
+	}
+	ttl, ok := cacheTTL(header, c.TTL)
+	if !ok {
+		return
+	}
+	vary := varyHeaders(header)
+	if slices.Contains(vary, "*") {
+		return
+	}
+
+	now := time.Now()
+	if len(vary) > 0 {
+		c.store(conn, key, cacheEntry{Vary: vary, Stored: now, Expires: now.Add(ttl)})
+		key = variantKey(key, vary, r)
+	}
+	c.store(conn, key, cacheEntry{
+		Header:  header,
+		Body:    body,
+		Stored:  now,
+		Expires: now.Add(ttl),
+	})
+}
+
+// store writes the entry to the KV bucket; errors are logged.
+func (c *Cache) store(conn *nats.Conn, key string, entry cacheEntry) {
+	kv, ok := c.keyValue(conn)
+	if !ok {
+		return
+	}
+	value, err := json.Marshal(entry)
+	if err == nil {
+		_, err = kv.Put(key, value)
+	}
+	if err != nil {
+		c.logger.Warn("could not write to cache", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// cacheTTL returns how long a reply may be cached according to its Cache-Control header; at most maxTTL.
+func cacheTTL(header http.Header, maxTTL time.Duration) (time.Duration, bool) {
+	ttl := maxTTL
+	sharedMaxAge := false
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.ToLower(strings.TrimSpace(directive)), "=")
+		switch name {
+		case "no-store", "no-cache", "private":
+			return 0, false
+		case "max-age", "s-maxage":
+			seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil || (name == "max-age" && sharedMaxAge) {
+				continue
+			}
+			sharedMaxAge = name == "s-maxage"
+			ttl = min(time.Duration(seconds)*time.Second, maxTTL)
+		}
+	}
+	return ttl, ttl > 0
+}
+
+// authenticated returns whether the reply to the request may be specific to the user.
+func authenticated(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != ""
+}
+
+// sharedCacheable returns whether the Cache-Control header explicitly allows shared caches to store the reply, also
+// for authenticated requests.
+func sharedCacheable(header http.Header) bool {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(directive)), "=")
+		if name == "public" || name == "s-maxage" {
+			return true
+		}
+	}
+	return false
+}
+
+// varyHeaders returns the canonicalized request header names of the Vary header; or "*".
+func varyHeaders(header http.Header) []string {
+	var vary []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" && name != "*" {
+				name = http.CanonicalHeaderKey(name)
+			}
+			if name != "" && !slices.Contains(vary, name) {
+				vary = append(vary, name)
+			}
+		}
+	}
+	return vary
+}
+
+// notModified returns whether the If-None-Match header of the request matches the ETag.
+func notModified(r *http.Request, etag string) bool {
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if etag == "" || ifNoneMatch == "" {
+		return false
+	}
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeResponse writes the reply headers and body; or 304 Not Modified for matching conditional requests, if
+// conditional is set.
+func writeResponse(w http.ResponseWriter, r *http.Request, header http.Header, body []byte, conditional bool) error {
+	for k, headers := range header {
+		for _, h := range headers {
+			w.Header().Add(k, h)
+		}
+	}
+	if conditional && notModified(r, w.Header().Get("ETag")) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	_, err := w.Write(body)
+	if err != nil {
+		return fmt.Errorf("could not write response back to HTTP Writer: %w", err)
+	}
+	return nil
+}
+
+// parseCache parses the cache subdirective. Syntax:
+//
+//	cache {
+//	    bucket name
+//	    ttl 5m
+//	    [key template]
+//	}
+func parseCache(d *caddyfile.Dispenser) (*Cache, error) {
+	c := &Cache{}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "bucket":
+			if !d.AllArgs(&c.Bucket) {
+				return nil, d.ArgErr()
+			}
+		case "key":
+			if !d.AllArgs(&c.Key) {
+				return nil, d.ArgErr()
+			}
+		case "ttl":
+			var ttl string
+			if !d.AllArgs(&ttl) {
+				return nil, d.ArgErr()
+			}
+			t, err := time.ParseDuration(ttl)
+			if err != nil {
+				return nil, d.Err("cache: ttl is not a valid duration")
+			}
+			c.TTL = t
+		default:
+			return nil, d.Errf("unrecognized cache subdirective: %s", d.Val())
+		}
+	}
+	if c.Bucket == "" || c.TTL == 0 {
+		return nil, d.Err("cache: bucket and ttl are required")
+	}
+	return c, nil
+}
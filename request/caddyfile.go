@@ -4,13 +4,42 @@ import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/sandstorm/caddy-nats-bridge/common"
+	"strconv"
 	"time"
 )
 
 // ParseRequestHandler parses the nats_request directive. Syntax:
 //
 //	nats_request [serverAlias] subject {
-//	    [timeout 1s]
+//	    [timeout 1s|placeholder [{
+//	        # see parseTimeoutDirective
+//	    }]]
+//	    [headers {
+//	        # see common.ParseHeaderPolicy
+//	    }]
+//	    [format raw|json|cloudevents [{
+//	        # see common.ParseMessageFormat
+//	    }]]
+//	    [compress gzip|zstd|s2 [min_size]]
+//	    [encrypt aes-gcm|nacl-box {
+//	        # see common.ParseEncryption
+//	    }]
+//	    [error_status no_responders|timeout|malformed_reply|invalid_subject|request_failed|circuit_open statusCode]
+//	    [on_no_responders error|next]
+//	    [retry {
+//	        # see parseRetry
+//	    }]
+//	    [hedge delay]
+//	    [cache {
+//	        # see parseCache
+//	    }]
+//	    [circuit_breaker {
+//	        # see parseCircuitBreaker
+//	    }]
+//	    [response_headers {
+//	        # see common.ParseHeaderPolicy
+//	    }]
 //	}
 func ParseRequestHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var p = Request{}
@@ -33,15 +62,92 @@ func (p *Request) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		for d.NextBlock(0) {
 			switch d.Val() {
 			case "timeout":
-				if !d.NextArg() {
+				err := p.parseTimeoutDirective(d)
+				if err != nil {
+					return err
+				}
+			case "headers":
+				headers, err := common.ParseHeaderPolicy(d)
+				if err != nil {
+					return err
+				}
+				p.Headers = headers
+			case "format":
+				format, err := common.ParseMessageFormat(d)
+				if err != nil {
+					return err
+				}
+				p.FormatRaw = format
+			case "compress":
+				compress, err := common.ParseCompression(d)
+				if err != nil {
+					return err
+				}
+				p.Compress = compress
+			case "encrypt":
+				encrypt, err := common.ParseEncryption(d)
+				if err != nil {
+					return err
+				}
+				p.Encrypt = encrypt
+			case "error_status":
+				var errType, status string
+				if !d.AllArgs(&errType, &status) {
 					return d.ArgErr()
 				}
-				t, err := time.ParseDuration(d.Val())
+				statusCode, err := strconv.Atoi(status)
 				if err != nil {
-					return d.Err("timeout is not a valid duration")
+					return d.Errf("error_status: invalid status code %s", status)
 				}
-
-				p.Timeout = t
+				if p.ErrorStatus == nil {
+					p.ErrorStatus = make(map[string]int)
+				}
+				p.ErrorStatus[errType] = statusCode
+				err = validateErrorStatus(p.ErrorStatus)
+				if err != nil {
+					return d.Err(err.Error())
+				}
+			case "retry":
+				retry, err := parseRetry(d)
+				if err != nil {
+					return err
+				}
+				p.Retry = retry
+			case "hedge":
+				var delay string
+				if !d.AllArgs(&delay) {
+					return d.ArgErr()
+				}
+				t, err := time.ParseDuration(delay)
+				if err != nil {
+					return d.Err("hedge delay is not a valid duration")
+				}
+				p.HedgeDelay = t
+			case "cache":
+				cache, err := parseCache(d)
+				if err != nil {
+					return err
+				}
+				p.Cache = cache
+			case "circuit_breaker":
+				circuitBreaker, err := parseCircuitBreaker(d)
+				if err != nil {
+					return err
+				}
+				p.CircuitBreaker = circuitBreaker
+			case "on_no_responders":
+				if !d.AllArgs(&p.OnNoResponders) {
+					return d.ArgErr()
+				}
+				if p.OnNoResponders != OnNoRespondersError && p.OnNoResponders != OnNoRespondersNext {
+					return d.Errf("on_no_responders must be %s or %s, got: %s", OnNoRespondersError, OnNoRespondersNext, p.OnNoResponders)
+				}
+			case "response_headers":
+				headers, err := common.ParseHeaderPolicy(d)
+				if err != nil {
+					return err
+				}
+				p.ResponseHeaders = headers
 			default:
 				return d.Errf("unrecognized subdirective: %s", d.Val())
 			}
@@ -0,0 +1,358 @@
+package request
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the states of a circuit breaker; also the values of the caddy_nats_request_circuit_breaker_state metric.
+const (
+	CircuitClosed   = 0
+	CircuitOpen     = 1
+	CircuitHalfOpen = 2
+)
+
+var circuitStateNames = map[int]string{
+	CircuitClosed:   "closed",
+	CircuitOpen:     "open",
+	CircuitHalfOpen: "half-open",
+}
+
+var circuitBreakerMetrics = struct {
+	init     sync.Once
+	state    *prometheus.GaugeVec
+	rejected *prometheus.CounterVec
+}{}
+
+func initCircuitBreakerMetrics() {
+	const ns, sub = "caddy", "nats_request"
+
+	circuitBreakerMetrics.state = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "circuit_breaker_state",
+		Help:      "State of the circuit breaker per subject pattern: 0 closed, 1 open, 2 half-open.",
+	}, []string{"subject"})
+	circuitBreakerMetrics.rejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "circuit_breaker_rejected_total",
+		Help:      "Number of requests rejected because the circuit breaker was open.",
+	}, []string{"subject"})
+}
+
+// circuitBreakers are the circuit breakers of the running configs, by config (identified by its NATS app) and subject
+// pattern.
+var circuitBreakers = struct {
+	sync.Mutex
+	byConfig map[any]map[string]*CircuitBreaker
+}{byConfig: map[any]map[string]*CircuitBreaker{}}
+
+// CircuitBreaker stops sending NATS requests for a while if too many of them fail; requests fail fast with the status
+// of ErrorCircuitOpen instead of waiting for the timeout. After OpenDuration, HalfOpenProbes requests are let through:
+// if they succeed, the circuit is closed again; otherwise it stays open for another OpenDuration.
+//
+// Timeouts, missing responders, failed requests and service error replies with status 5xx count as failures; as do
+// replies slower than LatencyThreshold. Requests cancelled by the client do not count.
+//
+// All nats_request handlers of a config with the same subject pattern share one circuit breaker, as they call the
+// same NATS service; so the metrics (labelled by subject pattern) are unambiguous. The metrics of a subject pattern
+// are removed once no running config has a circuit breaker for it anymore.
+type CircuitBreaker struct {
+	// ratio of failed requests (0-1) in the Window which opens the circuit; 0.5 if not set.
+	ErrorRatio float64 `json:"errorRatio,omitempty"`
+	// replies slower than this count as failures; latency is not considered if not set.
+	LatencyThreshold time.Duration `json:"latencyThreshold,omitempty"`
+	// minimum number of requests in the Window before the circuit can open; 10 if not set.
+	MinRequests int `json:"minRequests,omitempty"`
+	// the time window over which the error ratio is measured; 10s if not set.
+	Window time.Duration `json:"window,omitempty"`
+	// how long the circuit stays open before probing; 30s if not set.
+	OpenDuration time.Duration `json:"openDuration,omitempty"`
+	// number of successful probe requests needed to close the circuit; 1 if not set.
+	HalfOpenProbes int `json:"halfOpenProbes,omitempty"`
+
+	subject string
+	logger  *zap.Logger
+
+	mu          sync.Mutex
+	state       int
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int
+	probesOk    int
+}
+
+// Provision validates the configuration and sets the defaults; a nil CircuitBreaker is valid. It returns the circuit
+// breaker to use for the subject pattern: if another handler of the config has one for it already, that one (which
+// must be configured the same way).
+func (cb *CircuitBreaker) Provision(ctx caddy.Context, subject string, logger *zap.Logger) (*CircuitBreaker, error) {
+	if cb == nil {
+		return nil, nil
+	}
+	if cb.ErrorRatio < 0 || cb.ErrorRatio > 1 {
+		return nil, fmt.Errorf("circuit breaker: errorRatio must be between 0 and 1, got: %v", cb.ErrorRatio)
+	}
+	if cb.LatencyThreshold < 0 || cb.MinRequests < 0 || cb.Window < 0 || cb.OpenDuration < 0 || cb.HalfOpenProbes < 0 {
+		return nil, fmt.Errorf("circuit breaker: values must not be negative")
+	}
+	if cb.ErrorRatio == 0 {
+		cb.ErrorRatio = 0.5
+	}
+	if cb.MinRequests == 0 {
+		cb.MinRequests = 10
+	}
+	if cb.Window == 0 {
+		cb.Window = 10 * time.Second
+	}
+	if cb.OpenDuration == 0 {
+		cb.OpenDuration = 30 * time.Second
+	}
+	if cb.HalfOpenProbes == 0 {
+		cb.HalfOpenProbes = 1
+	}
+
+	app, err := ctx.App("nats")
+	if err != nil {
+		return nil, err
+	}
+	circuitBreakers.Lock()
+	defer circuitBreakers.Unlock()
+	breakers, ok := circuitBreakers.byConfig[app]
+	if !ok {
+		breakers = map[string]*CircuitBreaker{}
+		circuitBreakers.byConfig[app] = breakers
+		go func() {
+			<-ctx.Done()
+			circuitBreakers.Lock()
+			defer circuitBreakers.Unlock()
+			delete(circuitBreakers.byConfig, app)
+			deleteCircuitBreakerMetrics(breakers)
+		}()
+	}
+	if shared, ok := breakers[subject]; ok {
+		if !shared.sameConfig(cb) {
+			return nil, fmt.Errorf("circuit breaker: all circuit breakers for subject %s must be configured the same way, as they are shared", subject)
+		}
+		return shared, nil
+	}
+
+	cb.subject = subject
+	cb.logger = logger
+	breakers[subject] = cb
+	circuitBreakerMetrics.init.Do(initCircuitBreakerMetrics)
+	circuitBreakerMetrics.state.WithLabelValues(subject).Set(CircuitClosed)
+	return cb, nil
+}
+
+// deleteCircuitBreakerMetrics removes the metrics of the given (dropped) circuit breakers, unless the subject pattern
+// is still used by another config; f.e. the new config after a reload. circuitBreakers must be locked.
+func deleteCircuitBreakerMetrics(dropped map[string]*CircuitBreaker) {
+	for subject := range dropped {
+		used := false
+		for _, breakers := range circuitBreakers.byConfig {
+			if _, ok := breakers[subject]; ok {
+				used = true
+				break
+			}
+		}
+		if !used {
+			circuitBreakerMetrics.state.DeleteLabelValues(subject)
+			circuitBreakerMetrics.rejected.DeleteLabelValues(subject)
+		}
+	}
+}
+
+func (cb *CircuitBreaker) sameConfig(other *CircuitBreaker) bool {
+	return cb.ErrorRatio == other.ErrorRatio &&
+		cb.LatencyThreshold == other.LatencyThreshold &&
+		cb.MinRequests == other.MinRequests &&
+		cb.Window == other.Window &&
+		cb.OpenDuration == other.OpenDuration &&
+		cb.HalfOpenProbes == other.HalfOpenProbes
+}
+
+// Allow returns whether a request may be sent, and whether it is a probe of the half-open circuit; if it may not be
+// sent, also the time until the next probe is possible. Every allowed request must be followed by a call to Done or
+// Cancel.
+func (cb *CircuitBreaker) Allow() (allowed bool, probe bool, retryAfter time.Duration) {
+	if cb == nil {
+		return true, false, 0
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitOpen {
+		retryAfter := cb.OpenDuration - time.Since(cb.openedAt)
+		if retryAfter > 0 {
+			circuitBreakerMetrics.rejected.WithLabelValues(cb.subject).Inc()
+			return false, false, retryAfter
+		}
+		cb.setState(CircuitHalfOpen)
+		cb.probes = 0
+		cb.probesOk = 0
+	}
+	if cb.state == CircuitHalfOpen {
+		if cb.probes >= cb.HalfOpenProbes {
+			// the probes are still running.
+			circuitBreakerMetrics.rejected.WithLabelValues(cb.subject).Inc()
+			return false, false, time.Second
+		}
+		cb.probes++
+		return true, true, 0
+	}
+	return true, false, 0
+}
+
+// Done records the outcome of an allowed request. While the circuit is half-open, only the outcome of the probes
+// counts; requests sent before are ignored, as are probes of an earlier half-open state.
+func (cb *CircuitBreaker) Done(probe bool, failed bool, latency time.Duration) {
+	if cb == nil {
+		return
+	}
+	failed = failed || (cb.LatencyThreshold > 0 && latency > cb.LatencyThreshold)
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if probe != (cb.state == CircuitHalfOpen) {
+		return
+	}
+	switch cb.state {
+	case CircuitHalfOpen:
+		if failed {
+			cb.open()
+			return
+		}
+		cb.probesOk++
+		if cb.probesOk >= cb.HalfOpenProbes {
+			cb.setState(CircuitClosed)
+			cb.resetWindow()
+		}
+	case CircuitClosed:
+		if time.Since(cb.windowStart) > cb.Window {
+			cb.resetWindow()
+		}
+		cb.requests++
+		if failed {
+			cb.failures++
+		}
+		if cb.requests >= cb.MinRequests && float64(cb.failures)/float64(cb.requests) >= cb.ErrorRatio {
+			cb.open()
+		}
+	}
+}
+
+// Cancel records that an allowed request ended without outcome, f.e. because the client disconnected; so a probe
+// can be sent again.
+func (cb *CircuitBreaker) Cancel(probe bool) {
+	if cb == nil || !probe {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitHalfOpen && cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+func (cb *CircuitBreaker) open() {
+	if cb.state == CircuitHalfOpen {
+		cb.logger.Warn(
+			"circuit breaker probe failed, opened again",
+			zap.String("subject", cb.subject),
+			zap.Int("successful_probes", cb.probesOk),
+			zap.Duration("open_duration", cb.OpenDuration),
+		)
+	} else {
+		cb.logger.Warn(
+			"circuit breaker opened",
+			zap.String("subject", cb.subject),
+			zap.Int("requests", cb.requests),
+			zap.Int("failures", cb.failures),
+			zap.Duration("open_duration", cb.OpenDuration),
+		)
+	}
+	cb.setState(CircuitOpen)
+	cb.openedAt = time.Now()
+	cb.resetWindow()
+}
+
+func (cb *CircuitBreaker) resetWindow() {
+	cb.windowStart = time.Now()
+	cb.requests = 0
+	cb.failures = 0
+}
+
+func (cb *CircuitBreaker) setState(state int) {
+	if state != CircuitOpen && state != cb.state {
+		cb.logger.Info(
+			"circuit breaker state changed",
+			zap.String("subject", cb.subject),
+			zap.String("state", circuitStateNames[state]),
+		)
+	}
+	cb.state = state
+	circuitBreakerMetrics.state.WithLabelValues(cb.subject).Set(float64(state))
+}
+
+// retryAfterSeconds formats a duration for the Retry-After header (in seconds, rounded up).
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// parseCircuitBreaker parses the circuit_breaker subdirective. Syntax:
+//
+//	circuit_breaker {
+//	    [error_ratio 0.5]
+//	    [latency_threshold 500ms]
+//	    [min_requests 10]
+//	    [window 10s]
+//	    [open_duration 30s]
+//	    [half_open_probes 1]
+//	}
+func parseCircuitBreaker(d *caddyfile.Dispenser) (*CircuitBreaker, error) {
+	cb := &CircuitBreaker{}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		var value string
+		if !d.AllArgs(&value) {
+			return nil, d.ArgErr()
+		}
+		var err error
+		switch subdirective {
+		case "error_ratio":
+			cb.ErrorRatio, err = strconv.ParseFloat(value, 64)
+		case "latency_threshold":
+			cb.LatencyThreshold, err = time.ParseDuration(value)
+		case "min_requests":
+			cb.MinRequests, err = strconv.Atoi(value)
+		case "window":
+			cb.Window, err = time.ParseDuration(value)
+		case "open_duration":
+			cb.OpenDuration, err = time.ParseDuration(value)
+		case "half_open_probes":
+			cb.HalfOpenProbes, err = strconv.Atoi(value)
+		default:
+			return nil, d.Errf("unrecognized circuit_breaker subdirective: %s", subdirective)
+		}
+		if err != nil {
+			return nil, d.Errf("circuit_breaker: invalid %s: %s", subdirective, value)
+		}
+	}
+	return cb, nil
+}
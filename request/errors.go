@@ -0,0 +1,113 @@
+package request
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/nats-io/nats.go"
+	"github.com/sandstorm/caddy-nats-bridge/common"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+)
+
+// the types of errors of a NATS request; see Request.ErrorStatus.
+const (
+	// nobody is subscribed to the subject.
+	ErrorNoResponders = "no_responders"
+	// no reply within the timeout.
+	ErrorTimeout = "timeout"
+	// the reply could not be decrypted or decompressed.
+	ErrorMalformedReply = "malformed_reply"
+	// the subject (usually built from placeholders) is not a valid NATS subject.
+	ErrorInvalidSubject = "invalid_subject"
+	// the request could not be sent, f.e. because the connection is closed.
+	ErrorRequestFailed = "request_failed"
+	// the responder replied with a service error (Nats-Service-Error-Code header); its status code is used.
+	ErrorServiceError = "service_error"
+	// the circuit breaker is open; the request was not sent.
+	ErrorCircuitOpen = "circuit_open"
+)
+
+// DefaultErrorStatus is the HTTP status code for each error type, if not configured otherwise.
+var DefaultErrorStatus = map[string]int{
+	ErrorNoResponders:   http.StatusServiceUnavailable,
+	ErrorTimeout:        http.StatusGatewayTimeout,
+	ErrorMalformedReply: http.StatusBadGateway,
+	ErrorInvalidSubject: http.StatusBadRequest,
+	ErrorRequestFailed:  http.StatusBadGateway,
+	ErrorCircuitOpen:    http.StatusServiceUnavailable,
+}
+
+// errorType classifies an error returned by nats.Conn.RequestMsg.
+func errorType(err error) string {
+	switch {
+	case errors.Is(err, nats.ErrNoResponders):
+		return ErrorNoResponders
+	case errors.Is(err, nats.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return ErrorTimeout
+	case errors.Is(err, nats.ErrBadSubject):
+		return ErrorInvalidSubject
+	default:
+		return ErrorRequestFailed
+	}
+}
+
+// isFailure returns whether an error type indicates an unavailable NATS service; see CircuitBreaker. Requests cancelled
+// by the client are not passed here.
+func isFailure(errType string) bool {
+	return errType == ErrorNoResponders || errType == ErrorTimeout || errType == ErrorRequestFailed
+}
+
+// isFailedRequest returns whether a NATS request counts as failure for the circuit breaker: if it failed (see
+// isFailure), or the reply is a service error with status 5xx. The service error headers are not encrypted, so the
+// raw reply can be checked.
+func isFailedRequest(resp *nats.Msg, err error) bool {
+	if err != nil {
+		return isFailure(errorType(err))
+	}
+	statusCode, _, ok := common.ServiceError(resp)
+	return ok && statusCode >= 500
+}
+
+// validateErrorStatus checks the configured error types and status codes.
+func validateErrorStatus(errorStatus map[string]int) error {
+	for errType, statusCode := range errorStatus {
+		if _, ok := DefaultErrorStatus[errType]; !ok {
+			return fmt.Errorf("unknown error type %s", errType)
+		}
+		if statusCode < 400 || statusCode > 599 {
+			return fmt.Errorf("error status for %s must be between 400 and 599, got: %d", errType, statusCode)
+		}
+	}
+	return nil
+}
+
+// natsError sets the {nats.error.*} placeholders and returns a caddyhttp.HandlerError with the status code configured
+// for the error type; so that handle_errors blocks can render a proper error page. statusCode overrides the
+// configured status code if not 0 (f.e. for service errors).
+func (p Request) natsError(repl *caddy.Replacer, subject string, errType string, statusCode int, err error) error {
+	if statusCode == 0 {
+		statusCode = p.ErrorStatus[errType]
+	}
+	if statusCode == 0 {
+		statusCode = DefaultErrorStatus[errType]
+	}
+
+	repl.Set("nats.error", err.Error())
+	repl.Set("nats.error.type", errType)
+	repl.Set("nats.error.message", err.Error())
+	repl.Set("nats.error.subject", subject)
+	repl.Set("nats.error.status_code", strconv.Itoa(statusCode))
+
+	p.logger.Warn(
+		"NATS request failed",
+		zap.String("subject", subject),
+		zap.String("error_type", errType),
+		zap.Int("status", statusCode),
+		zap.Error(err),
+	)
+	return caddyhttp.Error(statusCode, err)
+}
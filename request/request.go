@@ -1,23 +1,63 @@
 package request
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
-	"github.com/nats-io/nats.go"
 	"github.com/sandstorm/caddy-nats-bridge/common"
 	"github.com/sandstorm/caddy-nats-bridge/natsbridge"
 	"go.uber.org/zap"
+	"io"
 	"net/http"
+	"strconv"
 	"time"
 )
 
+// the possible values of Request.OnNoResponders.
+const (
+	// fail with the status configured for ErrorNoResponders (default).
+	OnNoRespondersError = "error"
+	// continue with the next handler, f.e. a reverse_proxy to a legacy HTTP service.
+	OnNoRespondersNext = "next"
+)
+
 type Request struct {
 	Subject     string        `json:"subject,omitempty"`
 	Timeout     time.Duration `json:"timeout,omitempty"`
 	ServerAlias string        `json:"serverAlias,omitempty"`
-
+	// placeholder expression for the timeout, f.e. {http.request.header.X-Timeout}; as Go duration or milliseconds.
+	// Clamped to MinTimeout and MaxTimeout; Timeout is used if it is empty or invalid.
+	DynamicTimeout string        `json:"dynamicTimeout,omitempty"`
+	MinTimeout     time.Duration `json:"minTimeout,omitempty"`
+	MaxTimeout     time.Duration `json:"maxTimeout,omitempty"`
+	// filters and modifies the HTTP request headers transferred to the NATS message.
+	Headers *common.HeaderPolicy `json:"headers,omitempty"`
+	// filters and modifies the headers of the NATS reply transferred to the HTTP response.
+	ResponseHeaders *common.HeaderPolicy `json:"responseHeaders,omitempty"`
+	// how the HTTP request is represented as NATS message; raw if not set.
+	FormatRaw json.RawMessage `json:"format,omitempty" caddy:"namespace=nats.formats inline_key=format"`
+	// compresses the NATS message payload, and decompresses compressed replies; neither if not set.
+	Compress *common.Compression `json:"compress,omitempty"`
+	// encrypts the NATS message payload, and decrypts encrypted replies; not encrypted if not set.
+	Encrypt *common.Encryption `json:"encrypt,omitempty"`
+	// HTTP status code per error type (see ErrorNoResponders etc.); DefaultErrorStatus is used for unset types.
+	ErrorStatus map[string]int `json:"errorStatus,omitempty"`
+	// OnNoRespondersError or OnNoRespondersNext; what to do if nobody is subscribed to the subject.
+	OnNoResponders string `json:"onNoResponders,omitempty"`
+	// re-sends requests which failed with a timeout or no responders; not retried if not set.
+	Retry *Retry `json:"retry,omitempty"`
+	// sends a second (hedged) request if there is no reply after this delay, and uses the first reply; 0 disables
+	// hedging.
+	HedgeDelay time.Duration `json:"hedgeDelay,omitempty"`
+	// caches replies to GET requests in a JetStream KV bucket; not cached if not set.
+	Cache *Cache `json:"cache,omitempty"`
+	// fails fast while the NATS service is unavailable; no circuit breaker if not set.
+	CircuitBreaker *CircuitBreaker `json:"circuitBreaker,omitempty"`
+
+	format common.MessageFormat
 	logger *zap.Logger
 	app    *natsbridge.NatsBridgeApp
 }
@@ -45,6 +85,54 @@ func (p *Request) Provision(ctx caddy.Context) error {
 
 	p.app = natsAppIface.(*natsbridge.NatsBridgeApp)
 
+	err = p.validateTimeout()
+	if err != nil {
+		return err
+	}
+	err = p.Compress.Validate()
+	if err != nil {
+		return err
+	}
+	err = p.Encrypt.Provision()
+	if err != nil {
+		return err
+	}
+	err = validateErrorStatus(p.ErrorStatus)
+	if err != nil {
+		return err
+	}
+	err = p.Retry.Validate()
+	if err != nil {
+		return err
+	}
+	// with a dynamic timeout, requests with a timeout shorter than the hedge delay are not hedged; see requestHedged.
+	maxTimeout := p.Timeout
+	if p.DynamicTimeout != "" {
+		maxTimeout = p.MaxTimeout
+	}
+	if p.HedgeDelay < 0 || (p.HedgeDelay > 0 && p.HedgeDelay >= maxTimeout) {
+		return fmt.Errorf("hedgeDelay must be positive and smaller than the (maximum) timeout")
+	}
+	err = p.Cache.Provision(p.logger)
+	if err != nil {
+		return err
+	}
+	p.CircuitBreaker, err = p.CircuitBreaker.Provision(ctx, p.Subject, p.logger)
+	if err != nil {
+		return err
+	}
+	if p.OnNoResponders != "" && p.OnNoResponders != OnNoRespondersError && p.OnNoResponders != OnNoRespondersNext {
+		return fmt.Errorf("onNoResponders must be %s or %s, got: %s", OnNoRespondersError, OnNoRespondersNext, p.OnNoResponders)
+	}
+
+	if p.FormatRaw != nil {
+		val, err := ctx.LoadModule(p, "FormatRaw")
+		if err != nil {
+			return fmt.Errorf("loading format module: %v", err)
+		}
+		p.format = val.(common.MessageFormat)
+	}
+
 	return nil
 }
 
@@ -63,37 +151,90 @@ func (p Request) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhtt
 		return fmt.Errorf("NATS server alias %s not found", p.ServerAlias)
 	}
 
+	var cacheKey string
+	if p.Cache != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		cacheKey = p.Cache.key(repl)
+		if entry := p.Cache.get(server.Conn, cacheKey, r); entry != nil {
+			repl.Set("nats.cache.status", "hit")
+			w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.Stored).Seconds())))
+			return writeResponse(w, r, entry.Header, entry.Body, true)
+		}
+		repl.Set("nats.cache.status", "miss")
+	}
+
 	msg, err := common.NatsMsgForHttpRequest(r, subj)
 	if err != nil {
 		return err
 	}
-
-	resp, err := server.Conn.RequestMsg(msg, p.Timeout)
-	if err != nil {
-		return fmt.Errorf("could not request NATS message: %w", err)
+	// the request body is consumed by now; kept to restore it for the next handler (see OnNoResponders).
+	body := msg.Data
+	p.Headers.Apply(http.Header(msg.Header), repl)
+	if p.format != nil {
+		msg, err = p.format.Encode(msg, r, repl)
+		if err != nil {
+			return fmt.Errorf("could not encode NATS message: %w", err)
+		}
 	}
-
-	if err == nats.ErrNoResponders {
-		w.WriteHeader(http.StatusNotFound)
-		p.logger.Warn("No Responders for NATS subject - answering with HTTP Status Not Found.", zap.String("subject", subj))
+	err = p.Compress.Compress(msg)
+	if err != nil {
 		return err
-	} else if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	}
+	err = p.Encrypt.Encrypt(msg)
+	if err != nil {
 		return err
 	}
 
-	for k, headers := range resp.Header {
-		for _, header := range headers {
-			w.Header().Add(k, header)
-		}
+	allowed, probe, retryAfter := p.CircuitBreaker.Allow()
+	if !allowed && p.OnNoResponders == OnNoRespondersNext {
+		p.logger.Debug("circuit breaker open, continuing with next handler", zap.String("subject", subj))
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		return next.ServeHTTP(w, r)
+	}
+	if !allowed {
+		w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+		return p.natsError(repl, subj, ErrorCircuitOpen, 0, fmt.Errorf("circuit breaker open for %s", p.Subject))
+	}
+
+	start := time.Now()
+	resp, err := p.request(r.Context(), server.Conn, msg, p.timeout(repl))
+	if err != nil && r.Context().Err() != nil {
+		// the client disconnected; this says nothing about the NATS service.
+		p.CircuitBreaker.Cancel(probe)
+	} else {
+		p.CircuitBreaker.Done(probe, isFailedRequest(resp, err), time.Since(start))
+	}
+	if err != nil && p.OnNoResponders == OnNoRespondersNext && errorType(err) == ErrorNoResponders {
+		p.logger.Debug("no responders for NATS request, continuing with next handler", zap.String("subject", subj))
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		return next.ServeHTTP(w, r)
 	}
-	_, err = w.Write(resp.Data)
 	if err != nil {
-		return fmt.Errorf("could not write response back to HTTP Writer: %w", err)
+		return p.natsError(repl, subj, errorType(err), 0, fmt.Errorf("could not request NATS message: %w", err))
+	}
+
+	// replies of subscribe with encrypt or compress enabled; the HTTP client gets the plain body.
+	resp, err = p.Encrypt.Decrypt(resp)
+	if err == nil {
+		resp, err = p.Compress.Decompress(resp)
+	}
+	if err != nil {
+		return p.natsError(repl, subj, ErrorMalformedReply, 0, err)
+	}
+	if statusCode, description, ok := common.ServiceError(resp); ok {
+		return p.natsError(repl, subj, ErrorServiceError, statusCode, fmt.Errorf("service error: %s", description))
+	}
+
+	respHeader := http.Header(resp.Header)
+	if respHeader == nil {
+		respHeader = http.Header{}
+	}
+	p.ResponseHeaders.Apply(respHeader, repl)
+	if cacheKey != "" && r.Method == http.MethodGet {
+		p.Cache.put(server.Conn, cacheKey, r, respHeader, resp.Data)
 	}
 
 	// we are done :)
-	return nil
+	return writeResponse(w, r, respHeader, resp.Data, p.Cache != nil)
 }
 
 var (
@@ -3,10 +3,13 @@ package request_test
 import (
 	"fmt"
 	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
 	_ "github.com/sandstorm/caddy-nats-bridge"
 	"github.com/sandstorm/caddy-nats-bridge/integrationtest"
 	"io"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -169,3 +172,659 @@ func TestRequestToNats(t *testing.T) {
 		})
 	}
 }
+
+// TestRequestErrors checks that NATS errors are mapped to HTTP status codes, and can be rendered via handle_errors.
+func TestRequestErrors(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /default/* {
+				nats_request nobody.listening
+			}
+			route /configured/* {
+				nats_request nobody.listening {
+					error_status no_responders 404
+				}
+			}
+			route /timeout/* {
+				nats_request slow.service {
+					timeout 50ms
+				}
+			}
+			route /service-error/* {
+				nats_request failing.service
+			}
+			handle_errors {
+				respond "{nats.error.type} {nats.error.subject} {http.error.status_code}"
+			}
+		}
+	`, ""), "caddyfile")
+
+	// never responds
+	slowSub, err := tn.ClientConn.SubscribeSync("slow.service")
+	integrationtest.FailOnErr("error subscribing: %s", err, t)
+	defer slowSub.Unsubscribe()
+	failingSub, err := tn.ClientConn.Subscribe("failing.service", func(msg *nats.Msg) {
+		resp := nats.NewMsg(msg.Reply)
+		resp.Header.Set("Nats-Service-Error-Code", "429")
+		resp.Header.Set("Nats-Service-Error", "Too Many Requests")
+		_ = msg.RespondMsg(resp)
+	})
+	integrationtest.FailOnErr("error subscribing: %s", err, t)
+	defer failingSub.Unsubscribe()
+
+	cases := []struct {
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{path: "/default/x", expectedStatus: 503, expectedBody: "no_responders nobody.listening 503"},
+		{path: "/configured/x", expectedStatus: 404, expectedBody: "no_responders nobody.listening 404"},
+		{path: "/timeout/x", expectedStatus: 504, expectedBody: "timeout slow.service 504"},
+		{path: "/service-error/x", expectedStatus: 429, expectedBody: "service_error failing.service 429"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			res, err := http.Get("http://localhost:8889" + tc.path)
+			integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+			defer res.Body.Close()
+			b, err := io.ReadAll(res.Body)
+			integrationtest.FailOnErr("could not read response body: %s", err, t)
+
+			if res.StatusCode != tc.expectedStatus || string(b) != tc.expectedBody {
+				t.Fatalf("wrong response. Expected: %d %q. Actual: %d %q", tc.expectedStatus, tc.expectedBody, res.StatusCode, string(b))
+			}
+		})
+	}
+}
+
+// TestRequestOnNoRespondersNext checks that the request continues with the next handler (incl. the request body) if
+// nobody is subscribed to the subject; and is answered via NATS as soon as somebody is.
+func TestRequestOnNoRespondersNext(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /migrated/* {
+				nats_request migrated.service {
+					on_no_responders next
+				}
+				respond "legacy: {http.request.body}"
+			}
+		}
+	`, ""), "caddyfile")
+
+	assertResponse := func(expected string) {
+		res, err := http.Post("http://localhost:8889/migrated/x", "text/plain", strings.NewReader("hello"))
+		integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		integrationtest.FailOnErr("could not read response body: %s", err, t)
+
+		if res.StatusCode != http.StatusOK || string(b) != expected {
+			t.Fatalf("wrong response. Expected: 200 %q. Actual: %d %q", expected, res.StatusCode, string(b))
+		}
+	}
+
+	assertResponse("legacy: hello")
+
+	sub, err := tn.ClientConn.Subscribe("migrated.service", func(msg *nats.Msg) {
+		_ = msg.Respond([]byte("nats: " + string(msg.Data)))
+	})
+	integrationtest.FailOnErr("error subscribing: %s", err, t)
+	defer sub.Unsubscribe()
+	integrationtest.FailOnErr("error flushing: %s", tn.ClientConn.Flush(), t)
+
+	assertResponse("nats: hello")
+}
+
+// TestRequestRetryAndHedge checks that timed out requests are retried, and that hedged requests use the reply of the
+// second request if the first one is slow.
+func TestRequestRetryAndHedge(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /retry/* {
+				nats_request retry.service {
+					timeout 100ms
+					retry {
+						attempts 3
+						backoff 10ms
+						on timeout
+					}
+				}
+			}
+			route /hedge/* {
+				nats_request hedge.service {
+					timeout 1s
+					hedge 50ms
+				}
+			}
+		}
+	`, ""), "caddyfile")
+
+	// both services ignore the first request (like a single slow instance), and answer all further ones.
+	for _, subject := range []string{"retry.service", "hedge.service"} {
+		var requests atomic.Int32
+		sub, err := tn.ClientConn.Subscribe(subject, func(msg *nats.Msg) {
+			if requests.Add(1) > 1 {
+				_ = msg.Respond([]byte("body: " + string(msg.Data)))
+			}
+		})
+		integrationtest.FailOnErr("error subscribing: %s", err, t)
+		defer sub.Unsubscribe()
+	}
+	integrationtest.FailOnErr("error flushing: %s", tn.ClientConn.Flush(), t)
+
+	for _, path := range []string{"/retry/x", "/hedge/x"} {
+		t.Run(path, func(t *testing.T) {
+			start := time.Now()
+			res, err := http.Post("http://localhost:8889"+path, "text/plain", strings.NewReader("hello"))
+			integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+			defer res.Body.Close()
+			b, err := io.ReadAll(res.Body)
+			integrationtest.FailOnErr("could not read response body: %s", err, t)
+
+			if res.StatusCode != http.StatusOK || string(b) != "body: hello" {
+				t.Fatalf("wrong response. Expected: 200 %q. Actual: %d %q", "body: hello", res.StatusCode, string(b))
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Fatalf("request took too long: %s", elapsed)
+			}
+		})
+	}
+}
+
+// TestRequestHedgeDynamicTimeout checks that requests are only hedged if their dynamic timeout is longer than the
+// hedge delay.
+func TestRequestHedgeDynamicTimeout(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /hedge/* {
+				nats_request hedge.service {
+					timeout {http.request.header.X-Timeout} {
+						max 2s
+						default 1s
+					}
+					hedge 100ms
+				}
+			}
+		}
+	`, ""), "caddyfile")
+
+	// never answers, and counts the requests.
+	var requests atomic.Int32
+	sub, err := tn.ClientConn.Subscribe("hedge.service", func(msg *nats.Msg) {
+		requests.Add(1)
+	})
+	integrationtest.FailOnErr("error subscribing: %s", err, t)
+	defer sub.Unsubscribe()
+	integrationtest.FailOnErr("error flushing: %s", tn.ClientConn.Flush(), t)
+
+	for _, tc := range []struct {
+		timeout          string
+		expectedRequests int32
+	}{
+		{timeout: "50ms", expectedRequests: 1},
+		{timeout: "300ms", expectedRequests: 2},
+	} {
+		t.Run(tc.timeout, func(t *testing.T) {
+			requests.Store(0)
+			req, err := http.NewRequest("GET", "http://localhost:8889/hedge/x", nil)
+			integrationtest.FailOnErr("could not create request: %s", err, t)
+			req.Header.Set("X-Timeout", tc.timeout)
+			res, err := http.DefaultClient.Do(req)
+			integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusGatewayTimeout {
+				t.Fatalf("wrong status. Expected: %d. Actual: %d", http.StatusGatewayTimeout, res.StatusCode)
+			}
+			if actual := requests.Load(); actual != tc.expectedRequests {
+				t.Fatalf("wrong number of NATS requests. Expected: %d. Actual: %d", tc.expectedRequests, actual)
+			}
+		})
+	}
+}
+
+// TestRequestCircuitBreaker checks that the circuit breaker fails fast with a Retry-After header once too many requests
+// failed, and closes again after a successful probe.
+func TestRequestCircuitBreaker(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /breaker/* {
+				nats_request breaker.service {
+					circuit_breaker {
+						min_requests 2
+						error_ratio 0.5
+						open_duration 300ms
+					}
+				}
+			}
+			# shares the circuit breaker, as the subject is the same.
+			route /shared/* {
+				nats_request breaker.service {
+					circuit_breaker {
+						min_requests 2
+						error_ratio 0.5
+						open_duration 300ms
+					}
+				}
+			}
+			handle_errors {
+				respond "{nats.error.type}"
+			}
+		}
+	`, ""), "caddyfile")
+
+	assertResponseOf := func(path string, expectedStatus int, expectedBody string, expectedRetryAfter string) {
+		res, err := http.Get("http://localhost:8889" + path)
+		integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		integrationtest.FailOnErr("could not read response body: %s", err, t)
+
+		if res.StatusCode != expectedStatus || string(b) != expectedBody || res.Header.Get("Retry-After") != expectedRetryAfter {
+			t.Fatalf("%s: wrong response. Expected: %d %q Retry-After %q. Actual: %d %q Retry-After %q", path, expectedStatus, expectedBody, expectedRetryAfter, res.StatusCode, string(b), res.Header.Get("Retry-After"))
+		}
+	}
+	assertResponse := func(expectedStatus int, expectedBody string, expectedRetryAfter string) {
+		assertResponseOf("/breaker/x", expectedStatus, expectedBody, expectedRetryAfter)
+	}
+
+	// nobody listening: the circuit opens after two failed requests.
+	assertResponse(http.StatusServiceUnavailable, "no_responders", "")
+	assertResponse(http.StatusServiceUnavailable, "no_responders", "")
+	assertResponse(http.StatusServiceUnavailable, "circuit_open", "1")
+	assertResponseOf("/shared/x", http.StatusServiceUnavailable, "circuit_open", "1")
+
+	sub, err := tn.ClientConn.Subscribe("breaker.service", func(msg *nats.Msg) {
+		_ = msg.Respond([]byte("ok"))
+	})
+	integrationtest.FailOnErr("error subscribing: %s", err, t)
+	defer sub.Unsubscribe()
+	integrationtest.FailOnErr("error flushing: %s", tn.ClientConn.Flush(), t)
+
+	// still open, although the service is available again.
+	assertResponse(http.StatusServiceUnavailable, "circuit_open", "1")
+
+	// after open_duration, the probe succeeds and closes the circuit.
+	time.Sleep(350 * time.Millisecond)
+	assertResponse(http.StatusOK, "ok", "")
+	assertResponse(http.StatusOK, "ok", "")
+}
+
+// TestRequestCircuitBreakerServiceError checks that service error replies with status 5xx open the circuit (4xx do
+// not); and that the metrics of the circuit breaker are removed once it is no longer configured.
+func TestRequestCircuitBreakerServiceError(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /failing/* {
+				nats_request failing.{http.request.uri.path.asNatsSubject.1} {
+					circuit_breaker {
+						min_requests 2
+						error_ratio 0.5
+					}
+				}
+			}
+			handle_errors {
+				respond "{nats.error.type}"
+			}
+		}
+	`, ""), "caddyfile")
+
+	sub, err := tn.ClientConn.Subscribe("failing.*", func(msg *nats.Msg) {
+		resp := nats.NewMsg(msg.Reply)
+		resp.Header.Set("Nats-Service-Error", "failed")
+		if msg.Subject == "failing.client" {
+			resp.Header.Set("Nats-Service-Error-Code", "404")
+		} else {
+			resp.Header.Set("Nats-Service-Error-Code", "500")
+		}
+		_ = msg.RespondMsg(resp)
+	})
+	integrationtest.FailOnErr("error subscribing: %s", err, t)
+	defer sub.Unsubscribe()
+	integrationtest.FailOnErr("error flushing: %s", tn.ClientConn.Flush(), t)
+
+	assertResponse := func(path string, expectedBody string) {
+		res, err := http.Get("http://localhost:8889" + path)
+		integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		integrationtest.FailOnErr("could not read response body: %s", err, t)
+		if string(b) != expectedBody {
+			t.Fatalf("%s: wrong response. Expected: %q. Actual: %q", path, expectedBody, string(b))
+		}
+	}
+
+	// 4xx service errors are answers of an available service.
+	assertResponse("/failing/client", "service_error")
+	assertResponse("/failing/client", "service_error")
+	assertResponse("/failing/client", "service_error")
+
+	// the circuit breaker is shared by the subject pattern; so the successful requests above count as well.
+	assertResponse("/failing/server", "service_error")
+	assertResponse("/failing/server", "service_error")
+	assertResponse("/failing/server", "service_error")
+	assertResponse("/failing/server", "circuit_open")
+
+	const pattern = "failing.{http.request.uri.path.asNatsSubject.1}"
+	if !hasCircuitBreakerMetric(t, pattern) {
+		t.Fatalf("circuit breaker metric missing")
+	}
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			respond "no circuit breaker"
+		}
+	`, ""), "caddyfile")
+	// the old config is cleaned up asynchronously.
+	for i := 0; hasCircuitBreakerMetric(t, pattern); i++ {
+		if i == 10 {
+			t.Fatalf("the circuit breaker metric must be removed after the reload")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// hasCircuitBreakerMetric returns whether the circuit breaker state metric exists for the subject pattern.
+func hasCircuitBreakerMetric(t *testing.T, subject string) bool {
+	families, err := prometheus.DefaultGatherer.Gather()
+	integrationtest.FailOnErr("could not gather metrics: %s", err, t)
+	for _, family := range families {
+		if family.GetName() != "caddy_nats_request_circuit_breaker_state" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "subject" && label.GetValue() == subject {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// TestRequestCircuitBreakerClientDisconnect checks that requests cancelled by the client do not open the circuit.
+func TestRequestCircuitBreakerClientDisconnect(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /slow/* {
+				nats_request slow.service {
+					timeout 2s
+					circuit_breaker {
+						min_requests 2
+						error_ratio 0.5
+					}
+				}
+			}
+			handle_errors {
+				respond "{nats.error.type}"
+			}
+		}
+	`, ""), "caddyfile")
+
+	sub, err := tn.ClientConn.Subscribe("slow.service", func(msg *nats.Msg) {
+		time.Sleep(300 * time.Millisecond)
+		_ = msg.Respond([]byte("ok"))
+	})
+	integrationtest.FailOnErr("error subscribing: %s", err, t)
+	defer sub.Unsubscribe()
+	integrationtest.FailOnErr("error flushing: %s", tn.ClientConn.Flush(), t)
+
+	impatient := &http.Client{Timeout: 50 * time.Millisecond}
+	for i := 0; i < 3; i++ {
+		_, err := impatient.Get("http://localhost:8889/slow/x")
+		if err == nil {
+			t.Fatalf("the client should have given up before the reply")
+		}
+	}
+
+	res, err := http.Get("http://localhost:8889/slow/x")
+	integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	integrationtest.FailOnErr("could not read response body: %s", err, t)
+	if res.StatusCode != http.StatusOK || string(b) != "ok" {
+		t.Fatalf("the circuit must stay closed. Actual: %d %q", res.StatusCode, string(b))
+	}
+}
+
+// TestRequestDynamicTimeout checks that the timeout is taken from a placeholder, clamped to min and max, and sent to
+// the responder as X-NatsBridge-Deadline header.
+func TestRequestDynamicTimeout(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /dynamic/* {
+				nats_request dynamic.service {
+					timeout {http.request.header.X-Timeout} {
+						min 500ms
+						max 5s
+						default 1s
+					}
+				}
+			}
+		}
+	`, ""), "caddyfile")
+
+	// responds with the deadline
+	sub, err := tn.ClientConn.Subscribe("dynamic.service", func(msg *nats.Msg) {
+		_ = msg.Respond([]byte(msg.Header.Get("X-NatsBridge-Deadline")))
+	})
+	integrationtest.FailOnErr("error subscribing: %s", err, t)
+	defer sub.Unsubscribe()
+
+	cases := []struct {
+		header          string
+		expectedTimeout time.Duration
+	}{
+		{header: "2s", expectedTimeout: 2 * time.Second},
+		{header: "3000", expectedTimeout: 3 * time.Second},
+		{header: "", expectedTimeout: 1 * time.Second},
+		{header: "invalid", expectedTimeout: 1 * time.Second},
+		{header: "1h", expectedTimeout: 5 * time.Second},
+		{header: "1ms", expectedTimeout: 500 * time.Millisecond},
+	}
+	for _, tc := range cases {
+		t.Run(tc.header, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://localhost:8889/dynamic/x", nil)
+			integrationtest.FailOnErr("could not create request: %s", err, t)
+			if tc.header != "" {
+				req.Header.Set("X-Timeout", tc.header)
+			}
+			start := time.Now()
+			res, err := http.DefaultClient.Do(req)
+			integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+			defer res.Body.Close()
+			b, err := io.ReadAll(res.Body)
+			integrationtest.FailOnErr("could not read response body: %s", err, t)
+
+			deadline, err := time.Parse(time.RFC3339Nano, string(b))
+			integrationtest.FailOnErr("invalid X-NatsBridge-Deadline header: %s", err, t)
+			if actual := deadline.Sub(start); actual < tc.expectedTimeout-100*time.Millisecond || actual > tc.expectedTimeout+100*time.Millisecond {
+				t.Fatalf("wrong deadline. Expected timeout: %s. Actual: %s", tc.expectedTimeout, actual)
+			}
+		})
+	}
+}
+
+// TestRequestCache checks that replies are cached in a KV bucket according to their Cache-Control header, and that
+// conditional requests are answered with 304.
+func TestRequestCache(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /cached/* {
+				nats_request cached.{http.request.uri.path.asNatsSubject.1} {
+					cache {
+						bucket http_cache
+						ttl 1m
+					}
+				}
+			}
+		}
+	`, ""), "caddyfile")
+
+	js := tn.ResetJetStream(t)
+
+	var requests atomic.Int32
+	sub, err := tn.ClientConn.Subscribe("cached.*", func(msg *nats.Msg) {
+		n := requests.Add(1)
+		resp := nats.NewMsg(msg.Reply)
+		resp.Header.Set("ETag", `"v1"`)
+		switch msg.Subject {
+		case "cached.nostore":
+			resp.Header.Set("Cache-Control", "no-store")
+		case "cached.session":
+			resp.Header.Set("Cache-Control", "max-age=60")
+		case "cached.vary":
+			resp.Header.Set("Cache-Control", "public, max-age=60")
+			resp.Header.Set("Vary", "accept-language")
+		case "cached.varyall":
+			resp.Header.Set("Cache-Control", "public, max-age=60")
+			resp.Header.Set("Vary", "*")
+		case "cached.cookie":
+			resp.Header.Set("Cache-Control", "public, max-age=60")
+			resp.Header.Set("Set-Cookie", "session=new")
+		default:
+			resp.Header.Set("Cache-Control", "public, max-age=60")
+		}
+		resp.Data = []byte(fmt.Sprintf("reply %d", n))
+		_ = msg.RespondMsg(resp)
+	})
+	integrationtest.FailOnErr("error subscribing: %s", err, t)
+	defer sub.Unsubscribe()
+
+	assertResponse := func(path string, header map[string]string, expectedStatus int, expectedBody string) *http.Response {
+		req, err := http.NewRequest("GET", "http://localhost:8889"+path, nil)
+		integrationtest.FailOnErr("could not create request: %s", err, t)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		integrationtest.FailOnErr("could not read response body: %s", err, t)
+
+		if res.StatusCode != expectedStatus || string(b) != expectedBody {
+			t.Fatalf("wrong response for %s. Expected: %d %q. Actual: %d %q", path, expectedStatus, expectedBody, res.StatusCode, string(b))
+		}
+		return res
+	}
+
+	// the first request is answered via NATS, the second one from the cache.
+	res := assertResponse("/cached/a", nil, http.StatusOK, "reply 1")
+	if res.Header.Get("Age") != "" {
+		t.Fatalf("cache miss must not have an Age header, actual headers: %+v", res.Header)
+	}
+	res = assertResponse("/cached/a", nil, http.StatusOK, "reply 1")
+	if res.Header.Get("Age") == "" || res.Header.Get("ETag") != `"v1"` {
+		t.Fatalf("cache hit must have Age and ETag headers, actual headers: %+v", res.Header)
+	}
+	assertResponse("/cached/a", map[string]string{"If-None-Match": `"v1"`}, http.StatusNotModified, "")
+	assertResponse("/cached/a", map[string]string{"If-None-Match": `"v0"`}, http.StatusOK, "reply 1")
+
+	// conditional requests are also answered for cache misses.
+	assertResponse("/cached/b", map[string]string{"If-None-Match": `"v1"`}, http.StatusNotModified, "")
+
+	// no-store replies are not cached.
+	assertResponse("/cached/nostore", nil, http.StatusOK, "reply 3")
+	assertResponse("/cached/nostore", nil, http.StatusOK, "reply 4")
+
+	// authenticated requests are neither stored nor served from the cache, unless the reply is public.
+	cookie := map[string]string{"Cookie": "session=secret"}
+	assertResponse("/cached/session", cookie, http.StatusOK, "reply 5")
+	assertResponse("/cached/session", cookie, http.StatusOK, "reply 6")
+	assertResponse("/cached/session", nil, http.StatusOK, "reply 7")
+	assertResponse("/cached/session", nil, http.StatusOK, "reply 7")
+	assertResponse("/cached/session", cookie, http.StatusOK, "reply 8")
+	assertResponse("/cached/a", map[string]string{"Authorization": "Bearer secret"}, http.StatusOK, "reply 1")
+
+	// replies are cached per value of the Vary'd request headers; Vary: * is not cached.
+	assertResponse("/cached/vary", map[string]string{"Accept-Language": "de"}, http.StatusOK, "reply 9")
+	assertResponse("/cached/vary", map[string]string{"Accept-Language": "en"}, http.StatusOK, "reply 10")
+	assertResponse("/cached/vary", map[string]string{"Accept-Language": "de"}, http.StatusOK, "reply 9")
+	assertResponse("/cached/vary", map[string]string{"Accept-Language": "en"}, http.StatusOK, "reply 10")
+	assertResponse("/cached/varyall", nil, http.StatusOK, "reply 11")
+	assertResponse("/cached/varyall", nil, http.StatusOK, "reply 12")
+
+	// replies which set cookies are not cached, even if they are public.
+	assertResponse("/cached/cookie", nil, http.StatusOK, "reply 13")
+	assertResponse("/cached/cookie", nil, http.StatusOK, "reply 14")
+
+	// the cache is stored in the KV bucket, and shared with all nodes.
+	kv, err := js.KeyValue("http_cache")
+	integrationtest.FailOnErr("could not load KV bucket: %s", err, t)
+	keys, err := kv.Keys()
+	integrationtest.FailOnErr("could not list keys: %s", err, t)
+	// a, b, session, and vary with its two variants.
+	if len(keys) != 6 {
+		t.Fatalf("expected 6 cache entries, actual keys: %v", keys)
+	}
+}
+
+// TestRequestCacheUnavailable checks that requests still work if the KV bucket of the cache cannot be loaded; and that
+// the bucket is not looked up again on every request.
+func TestRequestCacheUnavailable(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /cached/* {
+				nats_request cached.{http.request.uri.path.asNatsSubject.1} {
+					cache {
+						bucket broken_cache
+						ttl 1m
+					}
+				}
+			}
+		}
+	`, ""), "caddyfile")
+
+	// a stream which looks like a KV bucket, but is not usable as one (no history per key).
+	js := tn.ResetJetStream(t)
+	_, err := js.AddStream(&nats.StreamConfig{Name: "KV_broken_cache", Subjects: []string{"$KV.broken_cache.>"}})
+	integrationtest.FailOnErr("could not create stream: %s", err, t)
+
+	sub, err := tn.ClientConn.Subscribe("cached.*", func(msg *nats.Msg) {
+		_ = msg.Respond([]byte("uncached"))
+	})
+	integrationtest.FailOnErr("error subscribing: %s", err, t)
+	defer sub.Unsubscribe()
+	lookups, err := tn.ClientConn.SubscribeSync("$JS.API.STREAM.INFO.KV_broken_cache")
+	integrationtest.FailOnErr("error subscribing: %s", err, t)
+	defer lookups.Unsubscribe()
+
+	for i := 0; i < 3; i++ {
+		res, err := http.Get("http://localhost:8889/cached/a")
+		integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+		b, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		integrationtest.FailOnErr("could not read response body: %s", err, t)
+		if res.StatusCode != http.StatusOK || string(b) != "uncached" {
+			t.Fatalf("wrong response. Expected: 200 uncached. Actual: %d %s", res.StatusCode, b)
+		}
+	}
+
+	integrationtest.FailOnErr("could not flush: %s", tn.ClientConn.Flush(), t)
+	count, _, err := lookups.Pending()
+	integrationtest.FailOnErr("could not count lookups: %s", err, t)
+	if count != 1 {
+		t.Fatalf("the KV bucket must be looked up once, and then skipped. Lookups: %d", count)
+	}
+}
@@ -0,0 +1,206 @@
+package request
+
+import (
+	"context"
+	"fmt"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+// DefaultRetryMaxBackoff caps the exponential backoff of Retry, if Retry.MaxBackoff is not set.
+const DefaultRetryMaxBackoff = 10 * time.Second
+
+// Retry re-sends a NATS request which failed with one of the given error types. The NATS message (incl. the request
+// body) is built once, and re-sent as is for every attempt.
+type Retry struct {
+	// total number of attempts, incl. the first one.
+	Attempts int `json:"attempts,omitempty"`
+	// delay before the first retry; doubled for each further retry. 0 retries immediately.
+	Backoff time.Duration `json:"backoff,omitempty"`
+	// maximum delay between two attempts; DefaultRetryMaxBackoff if not set.
+	MaxBackoff time.Duration `json:"maxBackoff,omitempty"`
+	// the error types to retry; ErrorTimeout and ErrorNoResponders if not set.
+	On []string `json:"on,omitempty"`
+}
+
+// Validate checks the configuration; a nil Retry is valid.
+func (rt *Retry) Validate() error {
+	if rt == nil {
+		return nil
+	}
+	if rt.Attempts < 1 {
+		return fmt.Errorf("retry: attempts must be at least 1, got: %d", rt.Attempts)
+	}
+	if rt.Backoff < 0 {
+		return fmt.Errorf("retry: backoff must not be negative")
+	}
+	if rt.MaxBackoff < 0 {
+		return fmt.Errorf("retry: max_backoff must not be negative")
+	}
+	for _, errType := range rt.On {
+		if errType != ErrorTimeout && errType != ErrorNoResponders {
+			return fmt.Errorf("retry: can only retry on %s or %s, got: %s", ErrorTimeout, ErrorNoResponders, errType)
+		}
+	}
+	return nil
+}
+
+// retryOn returns whether errors of the given type are retried.
+func (rt *Retry) retryOn(errType string) bool {
+	if len(rt.On) == 0 {
+		return errType == ErrorTimeout || errType == ErrorNoResponders
+	}
+	for _, t := range rt.On {
+		if t == errType {
+			return true
+		}
+	}
+	return false
+}
+
+// request sends the NATS request, retrying it according to p.Retry; and hedging each attempt if p.HedgeDelay is set.
+// Each attempt has the given timeout, and gets its own HeaderDeadline.
+func (p Request) request(ctx context.Context, conn *nats.Conn, msg *nats.Msg, timeout time.Duration) (*nats.Msg, error) {
+	attempts := 1
+	var backoff time.Duration
+	maxBackoff := DefaultRetryMaxBackoff
+	if p.Retry != nil {
+		attempts = p.Retry.Attempts
+		backoff = p.Retry.Backoff
+		if p.Retry.MaxBackoff > 0 {
+			maxBackoff = p.Retry.MaxBackoff
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		setDeadline(msg, timeout)
+		resp, err := p.requestHedged(ctx, conn, msg, timeout)
+		if err == nil || attempt >= attempts || !p.Retry.retryOn(errorType(err)) {
+			return resp, err
+		}
+
+		p.logger.Debug(
+			"retrying NATS request",
+			zap.String("subject", msg.Subject),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", min(backoff, maxBackoff)),
+			zap.Error(err),
+		)
+		select {
+		case <-time.After(min(backoff, maxBackoff)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+type requestResult struct {
+	resp *nats.Msg
+	err  error
+}
+
+// requestHedged sends the NATS request; if there is no reply after p.HedgeDelay, the request is sent a second time,
+// and the first reply is used. Useful for queue groups with a single slow member: the second request is likely
+// handled by another member. Both requests share the timeout, and are cancelled with ctx (f.e. if the client
+// disconnects). Requests are not hedged if the (dynamic) timeout is not longer than p.HedgeDelay.
+func (p Request) requestHedged(ctx context.Context, conn *nats.Conn, msg *nats.Msg, timeout time.Duration) (*nats.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if p.HedgeDelay == 0 || p.HedgeDelay >= timeout {
+		return conn.RequestMsgWithContext(ctx, msg)
+	}
+
+	// buffered, so that the request which lost the race does not block.
+	results := make(chan requestResult, 2)
+	send := func() {
+		resp, err := conn.RequestMsgWithContext(ctx, msg)
+		results <- requestResult{resp: resp, err: err}
+	}
+	go send()
+
+	hedge := time.NewTimer(p.HedgeDelay)
+	defer hedge.Stop()
+	select {
+	case res := <-results:
+		// a reply or an immediate error (f.e. no responders), which a second request would not fix.
+		return res.resp, res.err
+	case <-hedge.C:
+		p.logger.Debug("sending hedged NATS request", zap.String("subject", msg.Subject))
+		go send()
+	}
+
+	res := <-results
+	if res.err == nil {
+		return res.resp, nil
+	}
+	second := <-results
+	if second.err == nil {
+		return second.resp, nil
+	}
+	return nil, res.err
+}
+
+// parseRetry parses the retry subdirective. Syntax:
+//
+//	retry {
+//	    attempts 3
+//	    [backoff 100ms]
+//	    [max_backoff 10s]
+//	    [on timeout|no_responders...]
+//	}
+func parseRetry(d *caddyfile.Dispenser) (*Retry, error) {
+	rt := &Retry{}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "attempts":
+			var attempts string
+			if !d.AllArgs(&attempts) {
+				return nil, d.ArgErr()
+			}
+			n, err := strconv.Atoi(attempts)
+			if err != nil {
+				return nil, d.Errf("retry: attempts is not a number: %s", attempts)
+			}
+			rt.Attempts = n
+		case "backoff":
+			var backoff string
+			if !d.AllArgs(&backoff) {
+				return nil, d.ArgErr()
+			}
+			b, err := time.ParseDuration(backoff)
+			if err != nil {
+				return nil, d.Err("retry: backoff is not a valid duration")
+			}
+			rt.Backoff = b
+		case "max_backoff":
+			var maxBackoff string
+			if !d.AllArgs(&maxBackoff) {
+				return nil, d.ArgErr()
+			}
+			b, err := time.ParseDuration(maxBackoff)
+			if err != nil {
+				return nil, d.Err("retry: max_backoff is not a valid duration")
+			}
+			rt.MaxBackoff = b
+		case "on":
+			rt.On = d.RemainingArgs()
+			if len(rt.On) == 0 {
+				return nil, d.ArgErr()
+			}
+		default:
+			return nil, d.Errf("unrecognized retry subdirective: %s", d.Val())
+		}
+	}
+	err := rt.Validate()
+	if err != nil {
+		return nil, d.Err(err.Error())
+	}
+	return rt, nil
+}
@@ -0,0 +1,132 @@
+package request
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HeaderDeadline is set on every NATS request to the point in time (RFC 3339) when the bridge stops waiting for the
+// reply; so that services can give up early.
+const HeaderDeadline = "X-NatsBridge-Deadline"
+
+// validateTimeout checks the timeout configuration.
+func (p Request) validateTimeout() error {
+	if p.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	if p.DynamicTimeout == "" {
+		return nil
+	}
+	if p.MaxTimeout <= 0 {
+		return fmt.Errorf("maxTimeout is required for a dynamic timeout")
+	}
+	if p.MinTimeout < 0 || p.MinTimeout > p.MaxTimeout {
+		return fmt.Errorf("minTimeout must be between 0 and maxTimeout")
+	}
+	return nil
+}
+
+// timeout returns the timeout for the current request: DynamicTimeout clamped to MinTimeout and MaxTimeout; or Timeout
+// if DynamicTimeout is not set, empty or invalid.
+func (p Request) timeout(repl *caddy.Replacer) time.Duration {
+	if p.DynamicTimeout == "" {
+		return p.Timeout
+	}
+
+	timeout := p.Timeout
+	value := repl.ReplaceAll(p.DynamicTimeout, "")
+	if value != "" {
+		t, err := parseTimeoutValue(value)
+		if err != nil {
+			p.logger.Debug("invalid dynamic timeout, using the default", zap.String("value", value), zap.Error(err))
+		} else {
+			timeout = t
+		}
+	}
+
+	if timeout < p.MinTimeout {
+		return p.MinTimeout
+	}
+	if timeout > p.MaxTimeout {
+		return p.MaxTimeout
+	}
+	return timeout
+}
+
+// parseTimeoutValue parses a Go duration (f.e. 30s), or a number of milliseconds.
+func parseTimeoutValue(value string) (time.Duration, error) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// setDeadline sets the HeaderDeadline header for a request sent now with the given timeout.
+func setDeadline(msg *nats.Msg, timeout time.Duration) {
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	msg.Header.Set(HeaderDeadline, time.Now().Add(timeout).UTC().Format(time.RFC3339Nano))
+}
+
+// parseTimeoutDirective parses the timeout subdirective. Syntax:
+//
+//	timeout 1s
+//
+//	timeout {http.request.header.X-Timeout} {
+//	    max 30s
+//	    [min 100ms]
+//	    [default 1s]
+//	}
+func (p *Request) parseTimeoutDirective(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	if len(args) != 1 {
+		return d.ArgErr()
+	}
+	value := args[0]
+
+	if !strings.Contains(value, "{") {
+		t, err := time.ParseDuration(value)
+		if err != nil {
+			return d.Err("timeout is not a valid duration")
+		}
+		p.Timeout = t
+		if d.NextBlock(d.Nesting()) {
+			return d.Err("timeout: a block is only allowed for dynamic timeouts")
+		}
+		return nil
+	}
+
+	p.DynamicTimeout = value
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		var duration string
+		if !d.AllArgs(&duration) {
+			return d.ArgErr()
+		}
+		t, err := time.ParseDuration(duration)
+		if err != nil {
+			return d.Errf("timeout: %s is not a valid duration", subdirective)
+		}
+		switch subdirective {
+		case "min":
+			p.MinTimeout = t
+		case "max":
+			p.MaxTimeout = t
+		case "default":
+			p.Timeout = t
+		default:
+			return d.Errf("unrecognized timeout subdirective: %s", subdirective)
+		}
+	}
+	if p.MaxTimeout == 0 {
+		return d.Err("timeout: max is required for a dynamic timeout")
+	}
+	return nil
+}
@@ -1,17 +1,64 @@
 package subscribe
 
 import (
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	"github.com/sandstorm/caddy-nats-bridge/common"
+	"strconv"
 )
 
 // ParseSubscribeHandler parses the subscribe directive. Syntax:
 //
-//	subscribe subjectPattern HTTPMethod HTTPURL {
+//	subscribe subjectPattern HTTPMethod HTTPURL | passthrough [baseURL] {
 //	    [queue queueGroupName]
+//	    [max_concurrency n]
+//	    [on_saturation block|reject]
+//	    [pending_limits maxMsgs maxBytes]
+//	    [timeout duration]
+//	    [dead_letter subject]
+//	    [headers {
+//	        # see common.ParseHeaderPolicy
+//	    }]
+//	    [response_headers {
+//	        # see common.ParseHeaderPolicy
+//	    }]
+//	    [format raw|json|cloudevents [{
+//	        # see common.ParseMessageFormat
+//	    }]]
+//	    [compress gzip|zstd|s2 [min_size]]
+//	    [encrypt aes-gcm|nacl-box {
+//	        # see common.ParseEncryption
+//	    }]
+//	    [server serverName]
+//	    [handle {
+//	        # HTTP handler directives, like in a site block
+//	    }]
+//	    [retry {
+//	        [attempts n]
+//	        [backoff duration]
+//	        [max_backoff duration]
+//	        [on_status 5xx 429 ...]
+//	    }]
 //	}
 func ParseSubscribeHandler(d *caddyfile.Dispenser) (*Subscribe, error) {
 	s := Subscribe{}
-	if !d.Args(&s.Subject, &s.Method, &s.URL) {
+	if !d.Args(&s.Subject) {
+		return nil, d.ArgErr()
+	}
+	args := d.RemainingArgs()
+	switch {
+	case len(args) >= 1 && len(args) <= 2 && args[0] == "passthrough":
+		s.Passthrough = true
+		if len(args) == 2 {
+			s.URL = args[1]
+		}
+	case len(args) == 2:
+		s.Method, s.URL = args[0], args[1]
+	default:
 		return nil, d.ArgErr()
 	}
 
@@ -21,6 +68,95 @@ func ParseSubscribeHandler(d *caddyfile.Dispenser) (*Subscribe, error) {
 			if !d.AllArgs(&s.QueueGroup) {
 				return nil, d.ArgErr()
 			}
+		case "max_concurrency":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n < 0 {
+				return nil, d.Errf("max_concurrency must not be negative: %s", d.Val())
+			}
+			s.MaxConcurrency = n
+		case "on_saturation":
+			if !d.AllArgs(&s.OnSaturation) {
+				return nil, d.ArgErr()
+			}
+			if s.OnSaturation != OnSaturationBlock && s.OnSaturation != OnSaturationReject {
+				return nil, d.Errf("on_saturation must be %s or %s: %s", OnSaturationBlock, OnSaturationReject, s.OnSaturation)
+			}
+		case "pending_limits":
+			var msgs, bytes string
+			if !d.AllArgs(&msgs, &bytes) {
+				return nil, d.ArgErr()
+			}
+			var err error
+			s.PendingMsgsLimit, err = strconv.Atoi(msgs)
+			if err != nil {
+				return nil, d.Errf("pending_limits: invalid message limit: %s", msgs)
+			}
+			s.PendingBytesLimit, err = parseByteLimit(bytes)
+			if err != nil {
+				return nil, d.Errf("pending_limits: invalid byte limit: %s", bytes)
+			}
+		case "headers":
+			headers, err := common.ParseHeaderPolicy(d)
+			if err != nil {
+				return nil, err
+			}
+			s.Headers = headers
+		case "response_headers":
+			headers, err := common.ParseHeaderPolicy(d)
+			if err != nil {
+				return nil, err
+			}
+			s.ResponseHeaders = headers
+		case "format":
+			format, err := common.ParseMessageFormat(d)
+			if err != nil {
+				return nil, err
+			}
+			s.FormatRaw = format
+		case "compress":
+			compress, err := common.ParseCompression(d)
+			if err != nil {
+				return nil, err
+			}
+			s.Compress = compress
+		case "encrypt":
+			encrypt, err := common.ParseEncryption(d)
+			if err != nil {
+				return nil, err
+			}
+			s.Encrypt = encrypt
+		case "server":
+			if !d.AllArgs(&s.Server) {
+				return nil, d.ArgErr()
+			}
+		case "handle":
+			routes, err := parseInlineRoutes(d)
+			if err != nil {
+				return nil, err
+			}
+			s.Routes = routes
+		case "retry":
+			r, err := parseRetryPolicy(d)
+			if err != nil {
+				return nil, err
+			}
+			s.Retry = r
+		case "dead_letter":
+			if !d.AllArgs(&s.DeadLetter) {
+				return nil, d.ArgErr()
+			}
+		case "timeout":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			t, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("timeout is not a valid duration: %s", d.Val())
+			}
+			s.Timeout = t
 		default:
 			return nil, d.Errf("unrecognized subdirective: %s", d.Val())
 		}
@@ -28,3 +164,44 @@ func ParseSubscribeHandler(d *caddyfile.Dispenser) (*Subscribe, error) {
 
 	return &s, nil
 }
+
+// parseByteLimit accepts plain numbers (including -1 for unlimited) and human readable sizes like 64MB.
+func parseByteLimit(val string) (int, error) {
+	if n, err := strconv.Atoi(val); err == nil {
+		return n, nil
+	}
+	n, err := humanize.ParseBytes(val)
+	return int(n), err
+}
+
+// parseInlineRoutes parses the handle block of the subscribe directive like the body of a site block.
+//
+// httpcaddyfile.ParseSegmentAsSubroute cannot be used here, as it needs a Helper which is only available for
+// directives inside site blocks; so we let the HTTP Caddyfile adapter build the routes of a synthetic site instead.
+func parseInlineRoutes(d *caddyfile.Dispenser) (caddyhttp.RouteList, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	block := caddyfile.ServerBlock{
+		HasBraces: true,
+		Keys:      []caddyfile.Token{{File: d.File(), Line: d.Line(), Text: ":0"}},
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		block.Segments = append(block.Segments, d.NextSegment())
+	}
+
+	cfg, _, err := httpcaddyfile.ServerType{}.Setup([]caddyfile.ServerBlock{block}, map[string]any{})
+	if err != nil {
+		return nil, d.Errf("parsing handle block: %v", err)
+	}
+	var httpApp caddyhttp.App
+	err = json.Unmarshal(cfg.AppsRaw["http"], &httpApp)
+	if err != nil {
+		return nil, d.Errf("parsing handle block: %v", err)
+	}
+	for _, server := range httpApp.Servers {
+		return server.Routes, nil
+	}
+	return nil, d.Err("handle block is empty")
+}
@@ -0,0 +1,164 @@
+package subscribe
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRetryAttempts   = 3
+	DefaultRetryBackoff    = 100 * time.Millisecond
+	DefaultRetryMaxBackoff = 10 * time.Second
+)
+
+// RetryPolicy configures how often, and when, the HTTP call for a message is retried.
+type RetryPolicy struct {
+	// total number of attempts, including the first one.
+	Attempts int `json:"attempts,omitempty"`
+	// delay before the first retry; doubled for every further retry.
+	Backoff    time.Duration `json:"backoff,omitempty"`
+	MaxBackoff time.Duration `json:"maxBackoff,omitempty"`
+	// HTTP status codes to retry; either a real status code or the class of codes (f.e. 5 for all 5xx statuses),
+	// see caddyhttp.StatusCodeMatches. Defaults to 5xx.
+	OnStatus []int `json:"onStatus,omitempty"`
+}
+
+func (r *RetryPolicy) provision() {
+	if r.Attempts == 0 {
+		r.Attempts = DefaultRetryAttempts
+	}
+	if r.Backoff == 0 {
+		r.Backoff = DefaultRetryBackoff
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = DefaultRetryMaxBackoff
+	}
+	if len(r.OnStatus) == 0 {
+		r.OnStatus = []int{5}
+	}
+}
+
+// matchesStatus returns true if a response with the given status should be retried.
+func (r *RetryPolicy) matchesStatus(statusCode int) bool {
+	for _, configured := range r.OnStatus {
+		if caddyhttp.StatusCodeMatches(statusCode, configured) {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns how long to wait before the next attempt, after the given attempt (1-based) failed. A Retry-After
+// header of the response takes precedence over the exponential backoff; both are capped at MaxBackoff.
+func (r *RetryPolicy) delay(attempt int, header http.Header) time.Duration {
+	d := r.Backoff
+	for i := 1; i < attempt && d < r.MaxBackoff; i++ {
+		d *= 2
+	}
+	if retryAfter, ok := parseRetryAfter(header.Get("Retry-After")); ok {
+		d = retryAfter
+	}
+	if d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+	return d
+}
+
+// parseRetryAfter parses the Retry-After header, which is either a number of seconds or an HTTP date.
+func parseRetryAfter(val string) (time.Duration, bool) {
+	if val == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(val); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// parseRetryPolicy parses the retry block of the subscribe directive. Syntax:
+//
+//	retry {
+//	    [attempts n]
+//	    [backoff duration]
+//	    [max_backoff duration]
+//	    [on_status 5xx 429 ...]
+//	}
+func parseRetryPolicy(d *caddyfile.Dispenser) (*RetryPolicy, error) {
+	r := &RetryPolicy{}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "attempts":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n < 1 {
+				return nil, d.Errf("attempts must be a number >= 1: %s", d.Val())
+			}
+			r.Attempts = n
+		case "backoff", "max_backoff":
+			name := d.Val()
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			t, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("%s is not a valid duration: %s", name, d.Val())
+			}
+			if name == "backoff" {
+				r.Backoff = t
+			} else {
+				r.MaxBackoff = t
+			}
+		case "on_status":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return nil, d.ArgErr()
+			}
+			for _, arg := range args {
+				// also allow a comma separated list, f.e. "5xx,429"
+				for _, status := range strings.Split(arg, ",") {
+					code, err := parseStatusCode(status)
+					if err != nil {
+						return nil, d.Errf("on_status: %v", err)
+					}
+					r.OnStatus = append(r.OnStatus, code)
+				}
+			}
+		default:
+			return nil, d.Errf("unrecognized retry subdirective: %s", d.Val())
+		}
+	}
+
+	return r, nil
+}
+
+// parseStatusCode parses a status code like "429", or a class of status codes like "5xx" (represented as 5).
+func parseStatusCode(val string) (int, error) {
+	val = strings.TrimSpace(val)
+	if len(val) == 3 && strings.HasSuffix(val, "xx") {
+		val = val[:1]
+	}
+	code, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid status code: %s", val)
+	}
+	return code, nil
+}
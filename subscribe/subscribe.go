@@ -2,6 +2,9 @@ package subscribe
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
@@ -12,19 +15,96 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	// OnSaturationBlock stops taking messages from the subscription until a worker is free; so messages queue up
+	// in the pending buffer (backpressure).
+	OnSaturationBlock = "block"
+	// OnSaturationReject answers requests immediately with a 503 service error (see common.HeaderServiceError);
+	// messages without reply subject are dropped.
+	OnSaturationReject = "reject"
+)
+
+// the headers added to messages republished to the DeadLetter subject.
+const (
+	deadLetterSubjectHeader  = "X-NatsBridge-DeadLetter-Subject"
+	deadLetterReasonHeader   = "X-NatsBridge-DeadLetter-Reason"
+	deadLetterStatusHeader   = "X-NatsBridge-DeadLetter-Status"
+	deadLetterAttemptsHeader = "X-NatsBridge-DeadLetter-Attempts"
+)
+
+// DefaultPassthroughURL is the base URL used in passthrough mode if no URL is configured.
+const DefaultPassthroughURL = "http://localhost"
+
 type Subscribe struct {
-	Subject    string `json:"subject,omitempty"`
-	Method     string `json:"method,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	Method  string `json:"method,omitempty"`
+	// in passthrough mode, the base URL (host and base path) the original request path is appended to.
 	URL        string `json:"path,omitempty"`
 	QueueGroup string `json:"queue_group,omitempty"`
+	// rebuild method, path and query of the HTTP request from the X-NatsBridge-* headers (as set by nats_request
+	// and nats_publish); so that HTTP -> NATS -> HTTP round-trips are transparent. Method is used as fallback if
+	// the message has no X-NatsBridge-Method header.
+	Passthrough bool `json:"passthrough,omitempty"`
+	// filters and modifies the NATS message headers transferred to the HTTP request.
+	Headers *common.HeaderPolicy `json:"headers,omitempty"`
+	// filters and modifies the HTTP response headers transferred to the NATS reply.
+	ResponseHeaders *common.HeaderPolicy `json:"responseHeaders,omitempty"`
+	// the format of incoming messages (see nats.formats namespace); raw if not set.
+	FormatRaw json.RawMessage `json:"format,omitempty" caddy:"namespace=nats.formats inline_key=format"`
+	// compresses the payload of replies, and decompresses incoming compressed messages; neither if not set.
+	Compress *common.Compression `json:"compress,omitempty"`
+	// decrypts incoming encrypted messages, and encrypts replies.
+	Encrypt *common.Encryption `json:"encrypt,omitempty"`
+
+	// how many messages are handled in parallel; 0 or 1 handles them sequentially (in the order they arrive).
+	MaxConcurrency int `json:"maxConcurrency,omitempty"`
+	// what to do if all MaxConcurrency workers are busy: OnSaturationBlock (default) or OnSaturationReject.
+	OnSaturation string `json:"onSaturation,omitempty"`
+	// limits of the client-side buffer of messages not yet handled; if exceeded, messages are dropped and a
+	// slow consumer error is raised. 0 means the nats.go default; negative values mean unlimited.
+	PendingMsgsLimit  int `json:"pendingMsgsLimit,omitempty"`
+	PendingBytesLimit int `json:"pendingBytesLimit,omitempty"`
+	// maximum time for handling a single message; afterwards, the request context is cancelled and requests are
+	// answered with a 504 service error. 0 means no timeout.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// subject to republish messages to which could not be handled (invalid request, no matching server, timeout or
+	// HTTP status 5xx). Supports placeholders.
+	DeadLetter string `json:"deadLetter,omitempty"`
+	// retry the HTTP call for failed messages; no retries if not set.
+	Retry *RetryPolicy `json:"retry,omitempty"`
+	// name of the Caddy HTTP server to send the requests to; if empty, the server is determined from the
+	// listener address of the URL.
+	Server string `json:"server,omitempty"`
+	// inline handler chain; if set, requests are handled by these routes instead of the routes of a server. They run
+	// in the context of Server (f.e. for logging and trusted proxies); or of the first server by name if not set.
+	Routes caddyhttp.RouteList `json:"routes,omitempty"`
 
-	conn    *nats.Conn
-	sub     *nats.Subscription
+	conn *nats.Conn
+	sub  *nats.Subscription
+	// closed once the subscription is fully drained, see Unsubscribe()
+	drained  <-chan nats.SubStatus
+	inFlight *sync.WaitGroup
+	// closed by Unsubscribe(), to stop waiting for retries of in-flight messages.
+	stopping chan struct{}
+	// one token per worker; nil if messages are handled sequentially.
+	workers chan struct{}
+	// nil if FormatRaw is not set.
+	format  common.MessageFormat
 	ctx     caddy.Context
 	logger  *zap.Logger
 	httpApp *caddyhttp.App
+	// the server named in Server, or the server the Routes run in; nil if neither is configured.
+	server *caddyhttp.Server
+	// compiled Routes; nil if not configured.
+	routes caddyhttp.Handler
 }
 
 func (Subscribe) CaddyModule() caddy.ModuleInfo {
@@ -37,6 +117,51 @@ func (Subscribe) CaddyModule() caddy.ModuleInfo {
 func (s *Subscribe) Provision(ctx caddy.Context) error {
 	s.ctx = ctx
 	s.logger = ctx.Logger()
+	s.inFlight = &sync.WaitGroup{}
+	s.stopping = make(chan struct{})
+
+	if s.Passthrough && s.URL == "" {
+		s.URL = DefaultPassthroughURL
+	}
+
+	if s.MaxConcurrency < 0 {
+		return fmt.Errorf("max_concurrency must not be negative, got: %d", s.MaxConcurrency)
+	}
+	switch s.OnSaturation {
+	case "":
+		s.OnSaturation = OnSaturationBlock
+	case OnSaturationBlock, OnSaturationReject:
+	default:
+		return fmt.Errorf("on_saturation must be %s or %s, got: %s", OnSaturationBlock, OnSaturationReject, s.OnSaturation)
+	}
+	if s.Retry != nil {
+		s.Retry.provision()
+	}
+	if s.MaxConcurrency > 1 {
+		s.workers = make(chan struct{}, s.MaxConcurrency)
+	}
+	if s.Routes != nil {
+		err := s.Routes.Provision(ctx)
+		if err != nil {
+			return fmt.Errorf("provisioning inline routes: %w", err)
+		}
+		s.routes = s.Routes.Compile(emptyHandler)
+	}
+	err := s.Compress.Validate()
+	if err != nil {
+		return err
+	}
+	err = s.Encrypt.Provision()
+	if err != nil {
+		return err
+	}
+	if s.FormatRaw != nil {
+		val, err := ctx.LoadModule(s, "FormatRaw")
+		if err != nil {
+			return fmt.Errorf("loading format module: %w", err)
+		}
+		s.format = val.(common.MessageFormat)
+	}
 
 	return nil
 }
@@ -48,19 +173,30 @@ func (s *Subscribe) Subscribe(conn *nats.Conn) error {
 		zap.String("queue_group", s.QueueGroup),
 		zap.String("method", s.Method),
 		zap.String("url", s.URL),
+		zap.Int("max_concurrency", s.MaxConcurrency),
 	)
 
-	httpAppIface, err := s.ctx.App("http")
-	if err != nil {
-		return err
-	}
-	s.httpApp = httpAppIface.(*caddyhttp.App)
 	s.conn = conn
 
+	var err error
 	if s.QueueGroup != "" {
-		s.sub, err = conn.QueueSubscribe(s.Subject, s.QueueGroup, s.handler)
+		s.sub, err = conn.QueueSubscribe(s.Subject, s.QueueGroup, s.dispatch)
 	} else {
-		s.sub, err = conn.Subscribe(s.Subject, s.handler)
+		s.sub, err = conn.Subscribe(s.Subject, s.dispatch)
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.PendingMsgsLimit != 0 || s.PendingBytesLimit != 0 {
+		msgsLimit, bytesLimit := s.PendingMsgsLimit, s.PendingBytesLimit
+		if msgsLimit == 0 {
+			msgsLimit = nats.DefaultSubPendingMsgsLimit
+		}
+		if bytesLimit == 0 {
+			bytesLimit = nats.DefaultSubPendingBytesLimit
+		}
+		err = s.sub.SetPendingLimits(msgsLimit, bytesLimit)
 	}
 
 	return err
@@ -74,16 +210,162 @@ func (s *Subscribe) Unsubscribe(conn *nats.Conn) error {
 		zap.String("method", s.Method),
 		zap.String("url", s.URL),
 	)
+	close(s.stopping)
+
+	if s.sub == nil {
+		// Subscribe() failed or was never called
+		return nil
+	}
+
+	if !conn.IsConnected() {
+		// draining needs a round trip to the NATS server, which would block until the grace period is over; so
+		// pending messages are dropped (like on a disconnect), and only the in-flight handlers are waited for.
+		return s.sub.Unsubscribe()
+	}
 
+	// we need to listen for the status change before draining, to not miss it.
+	s.drained = s.sub.StatusChanged(nats.SubscriptionClosed)
 	return s.sub.Drain()
 }
 
+func (s *Subscribe) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		// the subscription must be fully drained before waiting for the in-flight handlers; otherwise a pending
+		// message could start a new handler (inFlight.Add) while we are already waiting.
+		if s.drained != nil {
+			<-s.drained
+		}
+		s.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("in-flight messages for subject %s not handled in time: %w", s.Subject, ctx.Err())
+	}
+}
+
+// Subscription returns the underlying NATS subscription; nil if not subscribed yet.
+func (s *Subscribe) Subscription() *nats.Subscription {
+	return s.sub
+}
+
+// dispatch is called by nats.go for every message, one after another. It hands the message over to a worker
+// (if MaxConcurrency is set), or handles it directly.
+func (s *Subscribe) dispatch(msg *nats.Msg) {
+	// must happen before returning, so that Wait() sees the message as in-flight once the subscription is drained.
+	s.inFlight.Add(1)
+
+	if s.workers == nil {
+		defer s.inFlight.Done()
+		s.handler(msg)
+		return
+	}
+
+	if s.OnSaturation == OnSaturationReject {
+		select {
+		case s.workers <- struct{}{}:
+		default:
+			defer s.inFlight.Done()
+			s.reject(msg)
+			return
+		}
+	} else {
+		// blocking here means nats.go does not deliver further messages; they pile up in the pending buffer.
+		s.workers <- struct{}{}
+	}
+
+	go func() {
+		defer func() {
+			<-s.workers
+			s.inFlight.Done()
+		}()
+		s.handler(msg)
+	}()
+}
+
+// reject answers the message with a 503 service error, because all workers are busy.
+func (s *Subscribe) reject(msg *nats.Msg) {
+	s.logger.Warn(
+		"all workers busy, rejecting NATS message",
+		zap.String("subject", msg.Subject),
+		zap.Int("max_concurrency", s.MaxConcurrency),
+		zap.Bool("with_reply", msg.Reply != ""),
+	)
+	s.respondError(msg, http.StatusServiceUnavailable, "max_concurrency reached")
+}
+
+// respondError answers the message with a service error (if it has a reply subject), so that the requester
+// knows why the request failed instead of running into its own timeout.
+func (s *Subscribe) respondError(msg *nats.Msg, statusCode int, description string) {
+	if msg.Reply == "" {
+		return
+	}
+
+	resp := nats.NewMsg(msg.Reply)
+	resp.Header.Set(common.HeaderServiceErrorCode, strconv.Itoa(statusCode))
+	resp.Header.Set(common.HeaderServiceError, http.StatusText(statusCode)+": "+description)
+	err := s.Encrypt.EncryptReply(resp)
+	if err == nil {
+		err = msg.RespondMsg(resp)
+	}
+	if err != nil {
+		s.logger.Error("could not send error response", zap.String("subject", msg.Subject), zap.Error(err))
+	}
+}
+
 func (s *Subscribe) handler(msg *nats.Msg) {
 	repl := caddy.NewReplacer()
-	common.AddNatsSubscribeVarsToReplacer(repl, msg)
 
+	decoded, err := s.decode(msg)
+	if err != nil {
+		common.AddNatsSubscribeVarsToReplacer(repl, msg)
+		s.logger.Error("could not decode NATS message", zap.String("subject", msg.Subject), zap.Error(err))
+		s.respondError(msg, http.StatusBadRequest, err.Error())
+		s.deadLetter(msg, repl, err, 0, 0)
+		return
+	}
+	common.AddNatsSubscribeVarsToReplacer(repl, decoded)
+
+	statusCode, attempts, err := s.handle(decoded, repl)
+	if err != nil {
+		s.logger.Error(
+			"error handling NATS message",
+			zap.String("subject", msg.Subject),
+			zap.Int("status", statusCode),
+			zap.Int("attempts", attempts),
+			zap.Error(err),
+		)
+		// the original (not decoded) message, so that it can be replayed as is.
+		s.deadLetter(msg, repl, err, statusCode, attempts)
+	}
+}
+
+// decode decrypts and decompresses the message (if configured), and converts it from the configured format into the raw
+// representation (HTTP headers as message headers, HTTP body as message data).
+func (s *Subscribe) decode(msg *nats.Msg) (*nats.Msg, error) {
+	msg, err := s.Encrypt.Decrypt(msg)
+	if err == nil {
+		msg, err = s.Compress.Decompress(msg)
+	}
+	if err != nil || s.format == nil {
+		return msg, err
+	}
+	return s.format.Decode(msg)
+}
+
+// handle converts the message to an HTTP request and runs it through Caddy (retrying it according to the Retry
+// policy); then replies once with the final HTTP response if the message has a reply subject. It returns an error if
+// the message could not be handled; statusCode is the HTTP status (if there was a response at all, otherwise 0).
+func (s *Subscribe) handle(msg *nats.Msg, repl *caddy.Replacer) (statusCode int, attempts int, err error) {
 	url := repl.ReplaceAll(s.URL, "")
 	method := repl.ReplaceAll(s.Method, "")
+	if s.Passthrough {
+		method, url = passthroughTarget(msg, method, url)
+	}
 
 	s.logger.Debug(
 		"handling message NATS on subject",
@@ -94,36 +376,318 @@ func (s *Subscribe) handler(msg *nats.Msg) {
 		zap.Bool("with_reply", msg.Reply != ""),
 	)
 
+	maxAttempts := 1
+	if s.Retry != nil {
+		maxAttempts = s.Retry.Attempts
+	}
+
+	var res attemptResult
+retries:
+	for attempts = 1; ; attempts++ {
+		res = s.attempt(msg, repl, method, url)
+		if attempts >= maxAttempts || res.statusCode == 0 || !s.Retry.matchesStatus(res.statusCode) {
+			// errors without HTTP response (invalid request, no matching server) will not get better by retrying.
+			break
+		}
+		delay := s.Retry.delay(attempts, res.header)
+		s.logger.Warn(
+			"retrying NATS message",
+			zap.String("subject", msg.Subject),
+			zap.Int("status", res.statusCode),
+			zap.Int("attempt", attempts),
+			zap.Duration("delay", delay),
+		)
+		select {
+		case <-time.After(delay):
+		case <-s.stopping:
+			// the last response is handled as the final one (f.e. sent to the dead letter subject), so that the
+			// shutdown is not delayed by retries.
+			break retries
+		}
+	}
+
+	if res.err == nil && s.Retry != nil && s.Retry.matchesStatus(res.statusCode) {
+		res.err = fmt.Errorf("HTTP handler responded with status %d", res.statusCode)
+	}
+
+	if msg.Reply != "" && res.statusCode != 0 {
+		// the incoming NATS Message has a reply subject set; so it was sent via request() (and not via publish()).
+		// -> so we can send the response back.
+		if res.timedOut {
+			s.respondError(msg, http.StatusGatewayTimeout, fmt.Sprintf("no response within %s", s.Timeout))
+			return res.statusCode, attempts, res.err
+		}
+		common.RemoveHopByHopHeaders(res.header)
+		s.ResponseHeaders.Apply(res.header, repl)
+		// res.statusCode -> TODO: new status code
+		resp := &nats.Msg{
+			Subject: msg.Reply,
+			Header:  nats.Header(res.header),
+			Data:    res.body,
+		}
+		respErr := s.Compress.Compress(resp)
+		if respErr == nil {
+			respErr = s.Encrypt.EncryptReply(resp)
+		}
+		if respErr == nil {
+			respErr = msg.RespondMsg(resp)
+		}
+		if respErr != nil {
+			return res.statusCode, attempts, fmt.Errorf("could not send response: %w", respErr)
+		}
+	}
+
+	return res.statusCode, attempts, res.err
+}
+
+type attemptResult struct {
+	// 0 if there was no HTTP response
+	statusCode int
+	header     http.Header
+	// only recorded if the message has a reply subject
+	body     []byte
+	timedOut bool
+	err      error
+}
+
+// attempt runs the message through the Caddy handler chain once.
+func (s *Subscribe) attempt(msg *nats.Msg, repl *caddy.Replacer, method string, url string) attemptResult {
 	req, err := s.prepareRequest(method, url, bytes.NewBuffer(msg.Data), msg.Header)
 	if err != nil {
-		s.logger.Error("error creating request", zap.Error(err))
-		return
+		return attemptResult{err: fmt.Errorf("error creating request: %w", err)}
+	}
+
+	if s.Passthrough {
+		// the headers are consumed; the receiving side should see the request as it was originally sent.
+		req.Header.Del(common.HeaderMethod)
+		req.Header.Del(common.HeaderUrlPath)
+		req.Header.Del(common.HeaderUrlQuery)
 	}
+	s.Headers.Apply(req.Header, repl)
 
-	server, err := s.matchServer(s.httpApp.Servers, req)
+	handler, err := s.httpHandler(msg, req, repl)
 	if err != nil {
-		s.logger.Error("error matching server", zap.Error(err))
-		return
+		return attemptResult{err: fmt.Errorf("error matching server: %w", err)}
 	}
 
-	if msg.Reply != "" {
-		// the incoming NATS Message has a reply subject set; so it was sent via request() (and not via publish()).
-		// -> so we can send the response back.
-		rec := httptest.NewRecorder()
-		server.ServeHTTP(rec, req)
-		// rec.Code -> TODO: new status code
-		//TODO Handle error
-		msg.RespondMsg(&nats.Msg{
-			Header: nats.Header(rec.Header()),
-			Data:   rec.Body.Bytes(),
-		})
+	if s.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), s.Timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	if msg.Reply == "" {
+		// the original NATS requester is not interested in the response - we only need status and headers to detect
+		// failures.
+		w := &statusResponseWriter{}
+		if !s.serveHTTP(handler, w, req) {
+			return attemptResult{statusCode: http.StatusGatewayTimeout, header: http.Header{}, timedOut: true, err: fmt.Errorf("no response within %s", s.Timeout)}
+		}
+		return attemptResult{statusCode: w.Status(), header: w.Header(), err: httpStatusError(w.Status())}
+	}
+
+	rec := httptest.NewRecorder()
+	if !s.serveHTTP(handler, rec, req) {
+		return attemptResult{statusCode: http.StatusGatewayTimeout, header: http.Header{}, timedOut: true, err: fmt.Errorf("no response within %s", s.Timeout)}
+	}
+	return attemptResult{statusCode: rec.Code, header: rec.Header(), body: rec.Body.Bytes(), err: httpStatusError(rec.Code)}
+}
+
+// passthroughTarget rebuilds method and URL of the original HTTP request from the X-NatsBridge-* headers; the
+// original path is appended to the path of baseURL.
+func passthroughTarget(msg *nats.Msg, fallbackMethod string, baseURL string) (method string, rawURL string) {
+	method = msg.Header.Get(common.HeaderMethod)
+	if method == "" {
+		method = fallbackMethod
+	}
+
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		// will fail again (and be reported) in prepareRequest
+		return method, baseURL
+	}
+	if urlPath := msg.Header.Get(common.HeaderUrlPath); urlPath != "" {
+		// cleaned, so that the original path cannot escape the base path via "..".
+		cleanPath := path.Clean("/" + urlPath)
+		if strings.HasSuffix(urlPath, "/") && cleanPath != "/" {
+			cleanPath += "/"
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + cleanPath
+		u.RawPath = ""
+	}
+	u.RawQuery = msg.Header.Get(common.HeaderUrlQuery)
+	return method, u.String()
+}
+
+// httpStatusError returns an error for server error status codes (5xx); they are considered failed deliveries.
+func httpStatusError(statusCode int) error {
+	if statusCode >= 500 {
+		return fmt.Errorf("HTTP handler responded with status %d", statusCode)
+	}
+	return nil
+}
+
+// deadLetter republishes a message which could not be handled to the DeadLetter subject (if configured); with the
+// original subject, headers and body - so that it can be inspected and replayed.
+func (s *Subscribe) deadLetter(msg *nats.Msg, repl *caddy.Replacer, reason error, statusCode int, attempts int) {
+	if s.DeadLetter == "" {
 		return
 	}
 
-	// no reply subject was set -> the original NATS requester is not interested in the response - we can ignore it.
-	server.ServeHTTP(common.NoopResponseWriter{}, req)
+	dlMsg := nats.NewMsg(repl.ReplaceAll(s.DeadLetter, ""))
+	for k, v := range msg.Header {
+		dlMsg.Header[k] = append([]string(nil), v...)
+	}
+	dlMsg.Header.Set(deadLetterSubjectHeader, msg.Subject)
+	dlMsg.Header.Set(deadLetterReasonHeader, reason.Error())
+	if statusCode != 0 {
+		dlMsg.Header.Set(deadLetterStatusHeader, strconv.Itoa(statusCode))
+	}
+	dlMsg.Header.Set(deadLetterAttemptsHeader, strconv.Itoa(attempts))
+	dlMsg.Data = msg.Data
+
+	err := s.conn.PublishMsg(dlMsg)
+	if err != nil {
+		s.logger.Error(
+			"could not publish message to dead letter subject",
+			zap.String("subject", msg.Subject),
+			zap.String("dead_letter", dlMsg.Subject),
+			zap.Error(err),
+		)
+	}
+}
+
+// statusResponseWriter discards the response, but remembers the status code.
+type statusResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *statusResponseWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = http.Header{}
+	}
+	return w.header
+}
+
+func (w *statusResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(p), nil
+}
+
+func (w *statusResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+// Status returns the HTTP status; 200 if the handler did not set one explicitly.
+func (w *statusResponseWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// serveHTTP runs the request through the Caddy handler chain. If a Timeout is configured, it returns false once
+// the request context expires - even if a handler does not respect the context cancellation and keeps running.
+// In this case, w must not be used anymore by the caller.
+func (s *Subscribe) serveHTTP(handler http.Handler, w http.ResponseWriter, req *http.Request) bool {
+	if s.Timeout <= 0 {
+		handler.ServeHTTP(w, req)
+		return true
+	}
+
+	done := make(chan struct{})
+	// a handler still running after the timeout is in-flight as well; so a graceful shutdown waits for it.
+	s.inFlight.Add(1)
+	go func() {
+		defer s.inFlight.Done()
+		defer close(done)
+		handler.ServeHTTP(w, req)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-req.Context().Done():
+		s.logger.Warn(
+			"timeout handling NATS message",
+			zap.String("subject", s.Subject),
+			zap.String("url", req.URL.String()),
+			zap.Duration("timeout", s.Timeout),
+		)
+		return false
+	}
+}
+
+// httpHandler returns the handler for the request: the inline Routes, the configured Server, or the server matching
+// the listener address of the request URL (in this order).
+func (s *Subscribe) httpHandler(msg *nats.Msg, req *http.Request, repl *caddy.Replacer) (http.Handler, error) {
+	if s.routes != nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.serveInlineRoutes(msg, repl, w, r)
+		}), nil
+	}
+	if s.server != nil {
+		return s.server, nil
+	}
+	return s.matchServer(s.httpApp.Servers, req)
+}
+
+// serveInlineRoutes runs the request through the inline Routes. This does what caddyhttp.Server.ServeHTTP does
+// for its routes: preparing the request context and converting handler errors to status codes. The replacer of the
+// message is used; so placeholders set by the routes are available afterwards (f.e. for the dead letter subject).
+func (s *Subscribe) serveInlineRoutes(msg *nats.Msg, repl *caddy.Replacer, w http.ResponseWriter, r *http.Request) {
+	r = caddyhttp.PrepareRequest(r, repl, w, s.server)
+
+	err := s.routes.ServeHTTP(w, r)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) && handlerErr.StatusCode != 0 {
+			statusCode = handlerErr.StatusCode
+		}
+		s.logger.Debug("inline route returned error", zap.String("subject", msg.Subject), zap.Int("status", statusCode), zap.Error(err))
+		w.WriteHeader(statusCode)
+	}
 }
 
+// ResolveDependencies loads the HTTP app, and the server the requests are sent to (see Server and Routes).
+func (s *Subscribe) ResolveDependencies() error {
+	httpAppIface, err := s.ctx.App("http")
+	if err != nil {
+		return err
+	}
+	s.httpApp = httpAppIface.(*caddyhttp.App)
+
+	switch {
+	case s.Server != "":
+		server, ok := s.httpApp.Servers[s.Server]
+		if !ok {
+			return fmt.Errorf("HTTP server %s not found (subscribe to %s)", s.Server, s.Subject)
+		}
+		s.server = server
+	case s.routes != nil:
+		// some handlers (f.e. reverse_proxy) expect a server in the request context.
+		names := make([]string, 0, len(s.httpApp.Servers))
+		for name := range s.httpApp.Servers {
+			names = append(names, name)
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("the handle block needs an HTTP server to run in, but none is configured (subscribe to %s)", s.Subject)
+		}
+		slices.Sort(names)
+		s.server = s.httpApp.Servers[names[0]]
+	}
+	return nil
+}
+
+// emptyHandler terminates the inline routes (like the empty handler of caddyhttp.Server).
+var emptyHandler caddyhttp.Handler = caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+
 func (s *Subscribe) matchServer(servers map[string]*caddyhttp.Server, req *http.Request) (*caddyhttp.Server, error) {
 	repl := caddy.NewReplacer()
 	for _, server := range servers {
@@ -177,8 +741,15 @@ func (s *Subscribe) prepareRequest(method string, rawURL string, body io.Reader,
 	}
 
 	req, err := http.NewRequest(method, rawURL, body)
-	if header != nil {
-		req.Header = http.Header(header)
+	if err != nil {
+		return nil, err
+	}
+	// copied, so that the original message headers stay untouched (f.e. for the dead letter subject). NATS header
+	// names are case-sensitive; so they are canonicalized, to be found via http.Header.
+	for k, values := range header {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
 	}
 
 	req.RequestURI = u.Path
@@ -186,10 +757,12 @@ func (s *Subscribe) prepareRequest(method string, rawURL string, body io.Reader,
 	//TODO: make User-Agent configurable
 	req.Header.Add("User-Agent", "caddy-nats")
 
-	return req, err
+	return req, nil
 }
 
 var (
-	_ caddy.Provisioner  = (*Subscribe)(nil)
-	_ common.NatsHandler = (*Subscribe)(nil)
+	_ caddy.Provisioner                  = (*Subscribe)(nil)
+	_ common.NatsHandler                 = (*Subscribe)(nil)
+	_ common.NatsHandlerWithSubscription = (*Subscribe)(nil)
+	_ common.NatsHandlerWithDependencies = (*Subscribe)(nil)
 )
@@ -1,13 +1,17 @@
 package subscribe_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
 	"github.com/nats-io/nats.go"
 	_ "github.com/sandstorm/caddy-nats-bridge"
+	"github.com/sandstorm/caddy-nats-bridge/common"
 	"github.com/sandstorm/caddy-nats-bridge/integrationtest"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -274,3 +278,794 @@ func TestSubscribeRequestToNats(t *testing.T) {
 		})
 	}
 }
+
+// TestSubscribeGracefulShutdown ensures in-flight messages are still handled (and replied to)
+// when Caddy reloads its config while a slow HTTP backend is processing the message.
+func TestSubscribeGracefulShutdown(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+
+	httpStarted := make(chan struct{})
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(httpStarted)
+		time.Sleep(500 * time.Millisecond)
+		_, _ = w.Write([]byte("slow resp"))
+	}))
+	t.Cleanup(svr.Close)
+
+	caddyfile := fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /test/* {
+				reverse_proxy %s
+			}
+			%s
+		}
+	`, `subscribe foo POST http://localhost:8889/test/something`, svr.URL, "%s")
+	caddyTester.InitServer(fmt.Sprintf(caddyfile, ""), "caddyfile")
+
+	natsResultChan := make(chan error)
+	go func() {
+		resp, err := tn.ClientConn.Request("foo", []byte("payload"), 3*time.Second)
+		if err != nil {
+			natsResultChan <- err
+			return
+		}
+		if string(resp.Data) != "slow resp" {
+			natsResultChan <- fmt.Errorf("response payload does not match expected. Actual: %s", string(resp.Data))
+			return
+		}
+		natsResultChan <- nil
+	}()
+
+	// reload Caddy (with a changed config) while the message is in-flight
+	<-httpStarted
+	caddyTester.InitServer(fmt.Sprintf(caddyfile, "respond /other 200"), "caddyfile")
+
+	if err := <-natsResultChan; err != nil {
+		t.Fatalf("NATS error: %s", err)
+	}
+}
+
+// TestSubscribeConcurrency checks that max_concurrency handles messages of a single subscription in parallel; and
+// that on_saturation reject answers with a 503 service error if all workers are busy.
+func TestSubscribeConcurrency(t *testing.T) {
+	type testCase struct {
+		description                string
+		GlobalNatsCaddyfileSnippet string
+		// number of requests sent in parallel
+		requests int
+		// expected number of requests rejected with 503
+		rejected int
+	}
+
+	cases := []testCase{
+		{
+			description: "max_concurrency handles messages in parallel",
+			GlobalNatsCaddyfileSnippet: `
+				subscribe foo POST http://localhost:8889/test/something {
+					max_concurrency 3
+				}
+			`,
+			requests: 3,
+			rejected: 0,
+		},
+		{
+			description: "on_saturation reject answers with 503 if all workers are busy",
+			GlobalNatsCaddyfileSnippet: `
+				subscribe foo POST http://localhost:8889/test/something {
+					max_concurrency 2
+					on_saturation reject
+				}
+			`,
+			requests: 3,
+			rejected: 1,
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.description, func(t *testing.T) {
+			tn := integrationtest.StartTestNats(t)
+			caddyTester := integrationtest.NewCaddyTester(t)
+
+			// each request takes 500ms; so sequential handling would run into the request timeout below.
+			svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(500 * time.Millisecond)
+				_, _ = w.Write([]byte("slow resp"))
+			}))
+			t.Cleanup(svr.Close)
+
+			caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+				:8889 {
+					route /test/* {
+						reverse_proxy %s
+					}
+				}
+			`, testCase.GlobalNatsCaddyfileSnippet, svr.URL), "caddyfile")
+
+			results := make(chan *nats.Msg, testCase.requests)
+			errs := make(chan error, testCase.requests)
+			for i := 0; i < testCase.requests; i++ {
+				go func() {
+					resp, err := tn.ClientConn.Request("foo", []byte("payload"), 900*time.Millisecond)
+					if err != nil {
+						errs <- err
+						return
+					}
+					results <- resp
+				}()
+			}
+
+			rejected := 0
+			for i := 0; i < testCase.requests; i++ {
+				select {
+				case err := <-errs:
+					t.Fatalf("NATS request failed: %s", err)
+				case resp := <-results:
+					if resp.Header.Get("Nats-Service-Error-Code") == "503" {
+						rejected++
+					} else if string(resp.Data) != "slow resp" {
+						t.Fatalf("response payload does not match expected. Actual: %s", string(resp.Data))
+					}
+				}
+			}
+			if rejected != testCase.rejected {
+				t.Fatalf("wrong number of rejected requests. Expected: %d. Actual: %d", testCase.rejected, rejected)
+			}
+		})
+	}
+}
+
+// TestSubscribeTimeout checks that a hanging backend is cancelled after the configured timeout, and the NATS
+// requester gets a 504 service error instead of running into its own timeout.
+func TestSubscribeTimeout(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+
+	httpCancelled := make(chan struct{})
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// net/http only notices a closed client connection once the request body is consumed.
+		_, _ = io.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+			close(httpCancelled)
+		case <-time.After(2 * time.Second):
+			_, _ = w.Write([]byte("too late"))
+		}
+	}))
+	t.Cleanup(svr.Close)
+
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /test/* {
+				reverse_proxy %s
+			}
+		}
+	`, `subscribe foo POST http://localhost:8889/test/something {
+			timeout 200ms
+		}`, svr.URL), "caddyfile")
+
+	resp, err := tn.ClientConn.Request("foo", []byte("payload"), 1*time.Second)
+	integrationtest.FailOnErr("NATS request failed: %s", err, t)
+	if code := resp.Header.Get("Nats-Service-Error-Code"); code != "504" {
+		t.Fatalf("wrong Nats-Service-Error-Code. Expected: 504. Actual: %s", code)
+	}
+
+	select {
+	case <-httpCancelled:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("upstream HTTP request was not cancelled")
+	}
+}
+
+// TestSubscribeDeadLetter checks that messages which could not be handled are republished to the dead_letter subject,
+// together with headers describing the failure.
+func TestSubscribeDeadLetter(t *testing.T) {
+	type testCase struct {
+		description                string
+		GlobalNatsCaddyfileSnippet string
+		expectedStatus             string
+		expectedReasonContains     string
+	}
+
+	cases := []testCase{
+		{
+			description: "HTTP status 5xx",
+			GlobalNatsCaddyfileSnippet: `
+				subscribe foo POST http://localhost:8889/fail {
+					dead_letter dlq.{nats.request.subject}
+				}
+			`,
+			expectedStatus:         "500",
+			expectedReasonContains: "status 500",
+		},
+		{
+			description: "no server matched",
+			GlobalNatsCaddyfileSnippet: `
+				subscribe foo POST http://localhost:9999/nothing {
+					dead_letter dlq.{nats.request.subject}
+				}
+			`,
+			expectedStatus:         "",
+			expectedReasonContains: "no server matched",
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.description, func(t *testing.T) {
+			tn := integrationtest.StartTestNats(t)
+			caddyTester := integrationtest.NewCaddyTester(t)
+			caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+				:8889 {
+					respond /fail 500
+				}
+			`, testCase.GlobalNatsCaddyfileSnippet), "caddyfile")
+
+			subscription, err := tn.ClientConn.SubscribeSync("dlq.>")
+			integrationtest.FailOnErr("error subscribing to dlq.>: %s", err, t)
+			defer subscription.Unsubscribe()
+
+			msg := nats.NewMsg("foo")
+			msg.Header.Set("MyHeader", "myHeaderValue")
+			msg.Data = []byte("payload")
+			err = tn.ClientConn.PublishMsg(msg)
+			integrationtest.FailOnErr("error publishing message: %s", err, t)
+
+			dlMsg, err := subscription.NextMsg(1 * time.Second)
+			integrationtest.FailOnErr("dead letter message not received: %s", err, t)
+
+			if dlMsg.Subject != "dlq.foo" {
+				t.Fatalf("wrong dead letter subject. Expected: dlq.foo. Actual: %s", dlMsg.Subject)
+			}
+			if string(dlMsg.Data) != "payload" {
+				t.Fatalf("wrong dead letter payload. Expected: payload. Actual: %s", string(dlMsg.Data))
+			}
+			if hdr := dlMsg.Header.Get("MyHeader"); hdr != "myHeaderValue" {
+				t.Fatalf("original header not preserved. Expected: myHeaderValue. Actual: %s", hdr)
+			}
+			if hdr := dlMsg.Header.Get("User-Agent"); hdr != "" {
+				t.Fatalf("header of the HTTP request leaked into the dead letter message: %s", hdr)
+			}
+			if hdr := dlMsg.Header.Get("X-NatsBridge-DeadLetter-Subject"); hdr != "foo" {
+				t.Fatalf("wrong X-NatsBridge-DeadLetter-Subject. Expected: foo. Actual: %s", hdr)
+			}
+			if hdr := dlMsg.Header.Get("X-NatsBridge-DeadLetter-Status"); hdr != testCase.expectedStatus {
+				t.Fatalf("wrong X-NatsBridge-DeadLetter-Status. Expected: %s. Actual: %s", testCase.expectedStatus, hdr)
+			}
+			if hdr := dlMsg.Header.Get("X-NatsBridge-DeadLetter-Reason"); !strings.Contains(hdr, testCase.expectedReasonContains) {
+				t.Fatalf("wrong X-NatsBridge-DeadLetter-Reason. Expected to contain: %s. Actual: %s", testCase.expectedReasonContains, hdr)
+			}
+			if hdr := dlMsg.Header.Get("X-NatsBridge-DeadLetter-Attempts"); hdr != "1" {
+				t.Fatalf("wrong X-NatsBridge-DeadLetter-Attempts. Expected: 1. Actual: %s", hdr)
+			}
+		})
+	}
+}
+
+// TestSubscribeRetry checks that failed HTTP calls are retried, and that the requester gets exactly one reply.
+func TestSubscribeRetry(t *testing.T) {
+	type testCase struct {
+		description                string
+		GlobalNatsCaddyfileSnippet string
+		// status codes returned by the backend for each call; the last one is repeated.
+		statusCodes []int
+		// whether the message is sent with a reply subject
+		withReply bool
+		// expected number of backend calls
+		expectedCalls int
+		// expected X-NatsBridge-DeadLetter-Attempts header; "" if no dead letter message is expected.
+		expectedDeadLetterAttempts string
+	}
+
+	cases := []testCase{
+		{
+			description: "request is retried until success, and replied once",
+			GlobalNatsCaddyfileSnippet: `
+				subscribe foo POST http://localhost:8889/test/something {
+					retry {
+						attempts 3
+						backoff 10ms
+						on_status 5xx,429
+					}
+					dead_letter dlq.foo
+				}
+			`,
+			statusCodes:                []int{502, 429, 200},
+			withReply:                  true,
+			expectedCalls:              3,
+			expectedDeadLetterAttempts: "",
+		},
+		{
+			description: "fire-and-forget message is dead-lettered after all attempts",
+			GlobalNatsCaddyfileSnippet: `
+				subscribe foo POST http://localhost:8889/test/something {
+					retry {
+						attempts 2
+						backoff 10ms
+					}
+					dead_letter dlq.foo
+				}
+			`,
+			statusCodes:                []int{503},
+			withReply:                  false,
+			expectedCalls:              2,
+			expectedDeadLetterAttempts: "2",
+		},
+		{
+			description: "status not in on_status is not retried",
+			GlobalNatsCaddyfileSnippet: `
+				subscribe foo POST http://localhost:8889/test/something {
+					retry {
+						attempts 3
+						backoff 10ms
+						on_status 503
+					}
+					dead_letter dlq.foo
+				}
+			`,
+			statusCodes:                []int{500},
+			withReply:                  false,
+			expectedCalls:              1,
+			expectedDeadLetterAttempts: "1",
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.description, func(t *testing.T) {
+			tn := integrationtest.StartTestNats(t)
+			caddyTester := integrationtest.NewCaddyTester(t)
+
+			calls := make(chan int, 10)
+			callCount := 0
+			svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				statusCode := testCase.statusCodes[min(callCount, len(testCase.statusCodes)-1)]
+				callCount++
+				calls <- callCount
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(statusCode)
+				_, _ = w.Write([]byte(fmt.Sprintf("resp %d", statusCode)))
+			}))
+			t.Cleanup(svr.Close)
+
+			caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+				:8889 {
+					route /test/* {
+						reverse_proxy %s
+					}
+				}
+			`, testCase.GlobalNatsCaddyfileSnippet, svr.URL), "caddyfile")
+
+			dlqSubscription, err := tn.ClientConn.SubscribeSync("dlq.foo")
+			integrationtest.FailOnErr("error subscribing to dlq.foo: %s", err, t)
+			defer dlqSubscription.Unsubscribe()
+
+			inbox := nats.NewInbox()
+			replySubscription, err := tn.ClientConn.SubscribeSync(inbox)
+			integrationtest.FailOnErr("error subscribing to inbox: %s", err, t)
+			defer replySubscription.Unsubscribe()
+
+			reply := ""
+			if testCase.withReply {
+				reply = inbox
+			}
+			err = tn.ClientConn.PublishRequest("foo", reply, []byte("payload"))
+			integrationtest.FailOnErr("error publishing message: %s", err, t)
+
+			if testCase.withReply {
+				resp, err := replySubscription.NextMsg(1 * time.Second)
+				integrationtest.FailOnErr("reply not received: %s", err, t)
+				if string(resp.Data) != "resp 200" {
+					t.Fatalf("wrong reply. Expected: resp 200. Actual: %s", string(resp.Data))
+				}
+			}
+
+			if testCase.expectedDeadLetterAttempts != "" {
+				dlMsg, err := dlqSubscription.NextMsg(1 * time.Second)
+				integrationtest.FailOnErr("dead letter message not received: %s", err, t)
+				if hdr := dlMsg.Header.Get("X-NatsBridge-DeadLetter-Attempts"); hdr != testCase.expectedDeadLetterAttempts {
+					t.Fatalf("wrong X-NatsBridge-DeadLetter-Attempts. Expected: %s. Actual: %s", testCase.expectedDeadLetterAttempts, hdr)
+				}
+			}
+
+			// wait a bit, so that unexpected retries, replies or dead letter messages would show up.
+			time.Sleep(200 * time.Millisecond)
+			if len(calls) != testCase.expectedCalls {
+				t.Fatalf("wrong number of backend calls. Expected: %d. Actual: %d", testCase.expectedCalls, len(calls))
+			}
+			if _, err := replySubscription.NextMsg(10 * time.Millisecond); err == nil {
+				t.Fatalf("more than one reply received")
+			}
+			if testCase.expectedDeadLetterAttempts == "" {
+				if _, err := dlqSubscription.NextMsg(10 * time.Millisecond); err == nil {
+					t.Fatalf("unexpected dead letter message received")
+				}
+			}
+		})
+	}
+}
+
+// TestSubscribeRetryInterruptedByShutdown checks that a reload does not wait for the backoff of retried messages; the
+// last response is handled as final one instead.
+func TestSubscribeRetryInterruptedByShutdown(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+
+	calls := make(chan struct{}, 10)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- struct{}{}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(svr.Close)
+
+	caddyfile := fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /test/* {
+				reverse_proxy %s
+			}
+			%s
+		}
+	`, `
+		subscribe foo POST http://localhost:8889/test/something {
+			retry {
+				attempts 5
+				backoff 10s
+			}
+			dead_letter dlq.foo
+		}
+	`, svr.URL, "%s")
+	caddyTester.InitServer(fmt.Sprintf(caddyfile, ""), "caddyfile")
+
+	dlqSubscription, err := tn.ClientConn.SubscribeSync("dlq.foo")
+	integrationtest.FailOnErr("error subscribing to dlq.foo: %s", err, t)
+	defer dlqSubscription.Unsubscribe()
+
+	err = tn.ClientConn.Publish("foo", []byte("payload"))
+	integrationtest.FailOnErr("error publishing message: %s", err, t)
+	select {
+	case <-calls:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("backend not called")
+	}
+
+	// reload Caddy while the message waits for its retry
+	start := time.Now()
+	caddyTester.InitServer(fmt.Sprintf(caddyfile, "respond /other 200"), "caddyfile")
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("reload waited for the retry backoff: %s", elapsed)
+	}
+
+	dlMsg, err := dlqSubscription.NextMsg(1 * time.Second)
+	integrationtest.FailOnErr("dead letter message not received: %s", err, t)
+	if hdr := dlMsg.Header.Get("X-NatsBridge-DeadLetter-Attempts"); hdr != "1" {
+		t.Fatalf("wrong X-NatsBridge-DeadLetter-Attempts. Expected: 1. Actual: %s", hdr)
+	}
+}
+
+// TestSubscribeServerAndInlineHandle checks that messages can be routed to a named Caddy server, or handled by
+// an inline handler chain - without matching a server by the listener address of the URL.
+func TestSubscribeServerAndInlineHandle(t *testing.T) {
+	type testCase struct {
+		description                string
+		GlobalNatsCaddyfileSnippet string
+		subject                    string
+		expectedResponse           string
+		expectedHeader             string
+	}
+
+	cases := []testCase{
+		{
+			description: "server sends the request to the named server, regardless of the URL",
+			GlobalNatsCaddyfileSnippet: `
+				subscribe greet.> GET http://localhost:9999/hello {
+					server srv0
+				}
+			`,
+			subject:          "greet.server",
+			expectedResponse: "hello from server",
+			expectedHeader:   "",
+		},
+		{
+			description: "inline handle block",
+			GlobalNatsCaddyfileSnippet: `
+				subscribe greet.> GET http://localhost:9999/hello {
+					handle {
+						header X-Inline yes
+						respond "hello from {nats.request.subject}"
+					}
+				}
+			`,
+			subject:          "greet.inline",
+			expectedResponse: "hello from greet.inline",
+			expectedHeader:   "yes",
+		},
+		{
+			description: "inline handle block with matchers",
+			GlobalNatsCaddyfileSnippet: `
+				subscribe greet.> GET http://localhost:9999/{nats.request.subject.asUriPath.1} {
+					handle {
+						handle /a {
+							respond "a"
+						}
+						handle /b {
+							respond "b"
+						}
+					}
+				}
+			`,
+			subject:          "greet.b",
+			expectedResponse: "b",
+			expectedHeader:   "",
+		},
+		{
+			description: "placeholders of the inline handle block are available in response_headers",
+			GlobalNatsCaddyfileSnippet: `
+				subscribe greet.> GET http://localhost:9999/hello {
+					handle {
+						map {nats.request.subject} {inline} {
+							greet.mapped yes
+							default no
+						}
+						respond "mapped"
+					}
+					response_headers {
+						set X-Inline {inline}
+					}
+				}
+			`,
+			subject:          "greet.mapped",
+			expectedResponse: "mapped",
+			expectedHeader:   "yes",
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.description, func(t *testing.T) {
+			tn := integrationtest.StartTestNats(t)
+			caddyTester := integrationtest.NewCaddyTester(t)
+			caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+				:8889 {
+					respond /hello "hello from server"
+				}
+			`, testCase.GlobalNatsCaddyfileSnippet), "caddyfile")
+
+			resp, err := tn.ClientConn.Request(testCase.subject, nil, 1*time.Second)
+			integrationtest.FailOnErr("NATS request failed: %s", err, t)
+			if string(resp.Data) != testCase.expectedResponse {
+				t.Fatalf("wrong response. Expected: %s. Actual: %s", testCase.expectedResponse, string(resp.Data))
+			}
+			if hdr := resp.Header.Get("X-Inline"); hdr != testCase.expectedHeader {
+				t.Fatalf("wrong X-Inline header. Expected: %s. Actual: %s", testCase.expectedHeader, hdr)
+			}
+		})
+	}
+}
+
+// TestSubscribePassthrough checks a transparent HTTP -> NATS -> HTTP round-trip: subscribe rebuilds the original
+// request from the X-NatsBridge-* headers set by nats_request.
+//
+//	HTTP PUT /api/x?a=1  ┌──────────────┐  NATS   ┌───────────────────────┐  HTTP PUT /backend/api/x?a=1
+//	───────────────────▶ │ nats_request │ ──────▶ │ subscribe passthrough │ ─────────────────────────────▶
+//	                     │ tunnel.api   │         │ .../backend           │
+//	                     └──────────────┘         └───────────────────────┘
+func TestSubscribePassthrough(t *testing.T) {
+	_ = integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /api/* {
+				nats_request tunnel.api
+			}
+			route /backend/* {
+				respond "{http.request.method} {http.request.uri} {http.request.header.X-NatsBridge-Method}"
+			}
+		}
+	`, `subscribe tunnel.api passthrough http://localhost:8889/backend`), "caddyfile")
+
+	req, err := http.NewRequest(http.MethodPut, "http://localhost:8889/api/x?a=1", strings.NewReader("payload"))
+	integrationtest.FailOnErr("error creating request: %s", err, t)
+	res, err := http.DefaultClient.Do(req)
+	integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	integrationtest.FailOnErr("could not read response body: %s", err, t)
+
+	// the X-NatsBridge-Method header must not be visible on the receiving side.
+	expected := "PUT /backend/api/x?a=1 "
+	if string(b) != expected {
+		t.Fatalf("wrong response. Expected: %q. Actual: %q", expected, string(b))
+	}
+}
+
+// TestSubscribeFormat sends a request as structured CloudEvent via NATS; subscribe decodes it and forwards it as
+// binary mode CloudEvent (Ce-* headers) to the HTTP handler.
+func TestSubscribeFormat(t *testing.T) {
+	_ = integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /api/* {
+				nats_request tunnel.api {
+					format cloudevents {
+						mode structured
+						type order.created
+					}
+				}
+			}
+			route /backend/* {
+				respond "{http.request.method} {http.request.uri} {http.request.header.Ce-Type} {http.request.header.Content-Type}"
+			}
+		}
+	`, `subscribe tunnel.api passthrough http://localhost:8889/backend {
+			format cloudevents
+		}`), "caddyfile")
+
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:8889/api/orders?a=1", strings.NewReader(`{"id": 42}`))
+	integrationtest.FailOnErr("error creating request: %s", err, t)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	integrationtest.FailOnErr("could not read response body: %s", err, t)
+
+	expected := "POST /backend/api/orders?a=1 order.created application/json"
+	if string(b) != expected {
+		t.Fatalf("wrong response. Expected: %q. Actual: %q", expected, string(b))
+	}
+}
+
+// TestSubscribeCompression sends a compressed request via nats_request; subscribe decompresses it and compresses
+// the reply, which nats_request decompresses again.
+func TestSubscribeCompression(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /api/* {
+				nats_request tunnel.api {
+					compress zstd
+				}
+			}
+			route /backend/* {
+				respond "{http.request.header.Content-Encoding} {http.request.header.Content-Length} {http.request.method} {http.request.uri}"
+			}
+		}
+	`, `subscribe tunnel.api passthrough http://localhost:8889/backend {
+			compress gzip
+		}`), "caddyfile")
+
+	// watch the messages on the wire
+	sub, err := tn.ClientConn.SubscribeSync("tunnel.api")
+	integrationtest.FailOnErr("error subscribing: %s", err, t)
+	defer sub.Unsubscribe()
+
+	body := strings.Repeat("compress me! ", 100)
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:8889/api/x", strings.NewReader(body))
+	integrationtest.FailOnErr("error creating request: %s", err, t)
+	res, err := http.DefaultClient.Do(req)
+	integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	integrationtest.FailOnErr("could not read response body: %s", err, t)
+
+	expected := fmt.Sprintf(" %d POST /backend/api/x", len(body))
+	if string(b) != expected {
+		t.Fatalf("wrong response. Expected: %q. Actual: %q", expected, string(b))
+	}
+	if res.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("the response must be decompressed, actual headers: %+v", res.Header)
+	}
+
+	msg, err := sub.NextMsg(time.Second)
+	integrationtest.FailOnErr("message not received: %s", err, t)
+	if msg.Header.Get(common.HeaderCompression) != "zstd" || msg.Header.Get("Content-Encoding") != "" || len(msg.Data) >= len(body) {
+		t.Fatalf("request message must be compressed, actual headers: %+v", msg.Header)
+	}
+}
+
+// TestSubscribeContentEncodingPassthrough checks that without compress configured, a compressed HTTP upload is
+// passed through the bridge untouched (and not decompressed by subscribe).
+func TestSubscribeContentEncodingPassthrough(t *testing.T) {
+	_ = integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /api/* {
+				nats_request tunnel.api
+			}
+			route /backend/* {
+				respond "{http.request.header.Content-Encoding} {http.request.header.Content-Length}"
+			}
+		}
+	`, `subscribe tunnel.api passthrough http://localhost:8889/backend`), "caddyfile")
+
+	var gzipped bytes.Buffer
+	w := gzip.NewWriter(&gzipped)
+	_, _ = w.Write([]byte(strings.Repeat("already compressed ", 100)))
+	_ = w.Close()
+
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:8889/api/x", bytes.NewReader(gzipped.Bytes()))
+	integrationtest.FailOnErr("error creating request: %s", err, t)
+	req.Header.Set("Content-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(req)
+	integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	integrationtest.FailOnErr("could not read response body: %s", err, t)
+
+	expected := fmt.Sprintf("gzip %d", gzipped.Len())
+	if string(b) != expected {
+		t.Fatalf("wrong response. Expected: %q. Actual: %q", expected, string(b))
+	}
+}
+
+// TestSubscribeEncryption sends an encrypted request via nats_request; subscribe decrypts it and encrypts the reply,
+// which nats_request decrypts again.
+func TestSubscribeEncryption(t *testing.T) {
+	tn := integrationtest.StartTestNats(t)
+	caddyTester := integrationtest.NewCaddyTester(t)
+	// the same key on both sides: 32 bytes, base64 encoded.
+	const key = "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE="
+	caddyTester.InitServer(fmt.Sprintf(integrationtest.DefaultCaddyConf+`
+		:8889 {
+			route /api/* {
+				nats_request tunnel.api {
+					compress gzip
+					encrypt aes-gcm {
+						key k1 `+key+`
+					}
+				}
+			}
+			route /backend/* {
+				respond "secret response to {http.request.method} {http.request.uri}"
+			}
+		}
+	`, `subscribe tunnel.api passthrough http://localhost:8889/backend {
+			encrypt aes-gcm {
+				key k1 `+key+`
+			}
+		}`), "caddyfile")
+
+	// watch the messages on the wire
+	sub, err := tn.ClientConn.SubscribeSync("tunnel.api")
+	integrationtest.FailOnErr("error subscribing: %s", err, t)
+	defer sub.Unsubscribe()
+
+	body := "my secret form submission"
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:8889/api/form", strings.NewReader(body))
+	integrationtest.FailOnErr("error creating request: %s", err, t)
+	res, err := http.DefaultClient.Do(req)
+	integrationtest.FailOnErr("HTTP request failed: %s", err, t)
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	integrationtest.FailOnErr("could not read response body: %s", err, t)
+
+	expected := "secret response to POST /backend/api/form"
+	if string(b) != expected {
+		t.Fatalf("wrong response. Expected: %q. Actual: %q", expected, string(b))
+	}
+
+	msg, err := sub.NextMsg(time.Second)
+	integrationtest.FailOnErr("message not received: %s", err, t)
+	if msg.Header.Get("X-NatsBridge-Encryption") != "aes-gcm" || msg.Header.Get("X-NatsBridge-Key-Id") != "k1" {
+		t.Fatalf("request message must be encrypted, actual headers: %+v", msg.Header)
+	}
+	if strings.Contains(string(msg.Data), "secret") {
+		t.Fatalf("request payload must not be readable: %q", msg.Data)
+	}
+
+	// neither injected messages without payload, nor captured messages sent to another path are handled.
+	injected := nats.NewMsg("tunnel.api")
+	injected.Header.Set("X-NatsBridge-Method", "DELETE")
+	injected.Header.Set("X-NatsBridge-UrlPath", "/api/form")
+	replayed := nats.NewMsg("tunnel.api")
+	replayed.Header = msg.Header
+	replayed.Header.Set("X-NatsBridge-UrlPath", "/api/admin")
+	replayed.Data = msg.Data
+	for name, m := range map[string]*nats.Msg{"injected": injected, "replayed": replayed} {
+		resp, err := tn.ClientConn.RequestMsg(m, time.Second)
+		integrationtest.FailOnErr("request failed: %s", err, t)
+		if resp.Header.Get("Nats-Service-Error-Code") != "400" || resp.Header.Get("X-NatsBridge-Encryption") != "aes-gcm" {
+			t.Fatalf("%s: message must be rejected with an encrypted error reply, actual headers: %+v", name, resp.Header)
+		}
+	}
+}